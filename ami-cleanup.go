@@ -3,7 +3,9 @@ package main
 import (
 	"flag"
 	"fmt"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -13,11 +15,20 @@ import (
 )
 
 type AMICommand struct {
-	verbose  bool
-	dryrun   bool
-	autoDays int
-	amiId    string
-	Ui       cli.Ui
+	verbose    bool
+	dryrun     bool
+	autoDays   int
+	keep       int
+	timeout    int
+	amiId      string
+	drRegions  string
+	force      bool
+	grace      int
+	rds        bool
+	policies   string
+	policyBook policyBook
+	retire     bool // set by commands retiring an AMI they replaced so no autocleanup tag is needed
+	Ui         cli.Ui
 }
 
 // Help function displays detailed help for ths ami-cleanup sub command
@@ -31,9 +42,50 @@ func (c *AMICommand) Help() string {
 
 	Flags:
 	-a <days> - Auto cleanup AMI & snapshots that have create date more then <days> ago
+	--keep <n> - Auto cleanup but always keep the newest <n> AMI's of each instance
+	--policies <file> - Auto cleanup AMI's using the retention policies in this file
 	-i <AMI Id> - Delete single AMI & snapshots
 	-n - Dry Run. Report on wnat would have been done but make no changes.
+	-t <minutes> - time to keep retrying snapshots still in use by a deregistered AMI. default 10
+	--dr-regions <regions> - comma separated DR regions to also cleanup copies in
+	--grace <days> - mark AMI's and snapshots pending-delete and only delete them
+		once they have been marked for this many days
+	--force - delete AMI's even if they are still in use
+	--rds - in auto mode also cleanup RDS DB snapshots made by snapshot --rds
 	-v - Produce verbose output
+
+	Retention policies keep AMI's per source instance. A policy such as
+	daily=7;weekly=4;monthly=12;newest=2 keeps the newest AMI in each of the
+	7 most recent days, 4 weeks and 12 months that have an AMI and always the
+	newest 2. days=<n> keeps AMI's younger than n days. An AMI is kept if any
+	part of the policy keeps it.
+	The policy file has one policy per line as name: policy. Each source instance
+	uses the policy of its newest AMI, from its autocleanup-policy tag holding a
+	policy or a policy name, from the policy named in its autobkup-retention tag,
+	from the policy named default, or else the -a days and --keep count.
+	Dry run shows the keep or delete reason for every AMI.
+
+	In auto mode volume snapshots created by snapshot --volumes are kept per
+	source volume with the same retention policies.
+
+	In auto mode AMI's copied to a DR region by snapshot are cleaned up in that
+	region with the same retention. DR regions are found from the
+	autobkup-dr-copy tags of the AMI's in this region and from --dr-regions.
+
+	AMI's still in use are not deleted unless --force is given. An AMI is in use
+	if an instance that is not terminated was launched from it, an auto scaling
+	launch configuration references it or it is shared with other accounts.
+
+	With --grace deletion takes two passes. The first pass tags the AMI and its
+	snapshots pending-delete=<time> and revokes the AMI launch permissions. A
+	later pass deletes them once the grace period is over. Shared AMI's are in
+	use so they are only marked with --force. A marked AMI or snapshot that is kept again,
+	such as after a policy change or because it is in use, has its pending state
+	cleared and its launch permissions restored. Use undelete to clear the
+	pending state and exempt an AMI or snapshot from cleanup.
+
+	With --rds the manual DB snapshots made by snapshot --rds are kept per DB
+	instance with the same retention policies, here and in their DR regions.
 	`
 }
 
@@ -52,16 +104,29 @@ func (c *AMICommand) Run(args []string) int {
 	cmdFlags.BoolVar(&c.dryrun, "n", false, "Dry Run")
 	cmdFlags.IntVar(&c.autoDays, "a", 0, "In auto cleanup mode, cleanup any AMI's older than this number of days")
 	cmdFlags.StringVar(&c.amiId, "i", "", "AMI to be deeted")
+	cmdFlags.IntVar(&c.keep, "keep", 0, "Always keep this many of the newest AMI's of each instance")
+	cmdFlags.StringVar(&c.policies, "policies", "", "Retention policy file")
+	cmdFlags.StringVar(&c.drRegions, "dr-regions", "", "DR regions to cleanup copies in")
+	cmdFlags.IntVar(&c.grace, "grace", 0, "Days AMI's stay pending-delete before they are deleted")
+	cmdFlags.BoolVar(&c.force, "force", false, "Delete AMI's even if they are still in use")
+	cmdFlags.BoolVar(&c.rds, "rds", false, "Also cleanup RDS DB snapshots in auto mode")
+	cmdFlags.IntVar(&c.timeout, "t", 10, "Minutes to retry deleting snapshots still in use")
 	if err := cmdFlags.Parse(args); err != nil {
 		return RCERR
 	}
 
 	// make sure we are in auto mode or an ami id has been provided
-	if c.autoDays == 0 && len(c.amiId) == 0 {
+	if !c.autoMode() && len(c.amiId) == 0 {
 		fmt.Printf("No ami details provided. Please provide an ami-id to cleanup\nor enable auto cleanup mode and specify a number of days.\n")
 		return RCERR
 	}
 
+	var err error
+	if c.policyBook, err = loadPolicies(c.policies); err != nil {
+		fmt.Printf("Fatal error: unable to load retention policies - %s\n", err)
+		return RCERR
+	}
+
 	// Create an EC2 service object
 	// config values keys, sercet key & region read from environment
 	svc := ec2.New(session.New(), &aws.Config{MaxRetries: aws.Int(10)})
@@ -71,7 +136,7 @@ func (c *AMICommand) Run(args []string) int {
 	var ec2dii ec2.DescribeImagesInput
 
 	// config for auto mode
-	if c.autoDays > 0 {
+	if c.autoMode() {
 
 		// auto mode search for ami's to cleanup
 		ec2Filter.Name = aws.String("tag-key")
@@ -85,11 +150,66 @@ func (c *AMICommand) Run(args []string) int {
 		ec2dii = ec2.DescribeImagesInput{ImageIds: []*string{aws.String(c.amiId)}}
 	}
 
-	imagesResp, err := svc.DescribeImages(&ec2dii)
+	imagesResp, rc := c.cleanupImages(svc, &ec2dii)
+
+	// volume snapshots made by snapshot --volumes follow the same retention policies
+	if c.autoMode() {
+		if c.cleanupVolumeSnapshots(svc) != RCOK {
+			rc = RCERR
+		}
+	}
+
+	// copies in DR regions follow the same retention as the AMI they were copied from
+	if c.autoMode() && imagesResp != nil {
+		for _, region := range drRegions(imagesResp.Images, c.drRegions) {
+
+			// Create an EC2 service object for the DR region
+			// config values keys & sercet key read from environment
+			drsvc := ec2.New(session.New(), &aws.Config{MaxRetries: aws.Int(10), Region: aws.String(region)})
+
+			if c.verbose {
+				fmt.Printf("Info - Cleaning up DR copies in region: %s\n", region)
+			}
+
+			drdii := ec2.DescribeImagesInput{
+				Owners: []*string{aws.String("self")},
+				Filters: []*ec2.Filter{
+					&ec2.Filter{
+						Name:   aws.String("tag-key"),
+						Values: []*string{aws.String("autocleanup")}},
+					&ec2.Filter{
+						Name:   aws.String("tag:autobkup-source-region"),
+						Values: []*string{svc.Config.Region}}}}
+
+			if _, drrc := c.cleanupImages(drsvc, &drdii); drrc != RCOK {
+				rc = drrc
+			}
+		}
+	}
+
+	// manual DB snapshots made by snapshot --rds follow the same retention policies
+	if c.autoMode() && c.rds {
+		if c.cleanupRDS(svc) != RCOK {
+			rc = RCERR
+		}
+	}
+
+	if c.verbose {
+		fmt.Printf("All done.\n")
+	}
+
+	return rc
+}
+
+// cleanupImages deregisters the images found by the describe input that have passed their
+// expire time and deletes their snapshots. It returns the images found
+func (c *AMICommand) cleanupImages(svc *ec2.EC2, ec2dii *ec2.DescribeImagesInput) (*ec2.DescribeImagesOutput, int) {
+
+	imagesResp, err := svc.DescribeImages(ec2dii)
 
 	if err != nil {
 		fmt.Printf("Fatal error: %s\n", err)
-		return RCERR
+		return nil, RCERR
 	}
 
 	// AWS response is ok to work with
@@ -97,111 +217,291 @@ func (c *AMICommand) Run(args []string) int {
 	// sanity check to make sure we don't remove all images from account
 	if len(imagesResp.Images) == 0 {
 		if c.verbose {
-			fmt.Printf("No images found to cleanup. Exiting\n")
+			fmt.Printf("No images found to cleanup\n")
+		}
+		return imagesResp, RCOK
+	}
+
+	decisions := c.imageDecisions(imagesResp.Images)
+	exempt(decisions)
+	rc := c.protectInUse(svc, decisions)
+
+	// AMI's marked pending-delete that are now kept start a new grace period if deleted later
+	if c.unmarkKept(svc, decisions) != RCOK {
+		rc = RCERR
+	}
+
+	// with a grace period AMI's are marked pending-delete and only deleted on a later pass
+	if c.grace > 0 {
+		if c.softDelete(svc, decisions, time.Now()) != RCOK {
+			rc = RCERR
 		}
-		return RCOK
 	}
 
 	// snapshots contains a list of all snapshotID's that need to be deleted from all deregistered AMI's
 	var snapshots []string
 
-	//
-	for image := range imagesResp.Images {
-
-		// The returned Images from AWS should only be the ones with autocleanup but lets check anyway
-		// and only delete if the days have passed
-
-		for tag := range imagesResp.Images[image].Tags {
-			if *imagesResp.Images[image].Tags[tag].Key == "autocleanup" {
-				// check if time is up for this AMI
-
-				// extract the time this AMI was created
-				amiCreation, _ := strconv.ParseInt(*imagesResp.Images[image].Tags[tag].Value, 10, 64)
-				amiLifeSpan := time.Now().Unix() - amiCreation
-
-				if int64(c.autoDays*86000) < amiLifeSpan {
-
-					if c.verbose {
-						fmt.Printf("Info - Deregistering AMI: %s\n", *imagesResp.Images[image].ImageId)
-					}
-
-					if c.dryrun == false {
-						ec2dii := &ec2.DeregisterImageInput{
-							ImageId: imagesResp.Images[image].ImageId, // Required
-						}
-
-						_, err = svc.DeregisterImage(ec2dii)
-
-						if err != nil {
-							fmt.Printf("error deregistering AMI %s. Image and snapshots not cleaned up. Error details\n%si\n",
-								*imagesResp.Images[image].ImageId,
-								err)
-							// continue with next tag
-							continue
-						}
-					} else {
-						fmt.Printf("Dry Run - Would have deregistered image: %s\n", *imagesResp.Images[image].ImageId)
-
-					}
-					for blockDM := range imagesResp.Images[image].BlockDeviceMappings {
-						// some block devices are not on EBS
-						if imagesResp.Images[image].BlockDeviceMappings[blockDM].Ebs == nil {
-							continue
-						}
-						if len(*imagesResp.Images[image].BlockDeviceMappings[blockDM].Ebs.SnapshotId) > 0 {
-							if c.verbose {
-								fmt.Printf("Info - Will delete associated snapshot: %s from ami: %s\n",
-									*imagesResp.Images[image].BlockDeviceMappings[blockDM].Ebs.SnapshotId,
-									*imagesResp.Images[image].ImageId)
-							}
-							snapshots = append(snapshots, *imagesResp.Images[image].BlockDeviceMappings[blockDM].Ebs.SnapshotId)
-						}
-					}
-					if c.verbose {
-						fmt.Printf("Info - AMI: %s deregistered\n", *imagesResp.Images[image].ImageId)
-					}
-				} else {
-					if c.verbose {
-						fmt.Printf("Info - Not deregistering AMI: %s as expire time not reached\n", *imagesResp.Images[image].ImageId)
-					}
-				}
+	for _, ri := range decisions {
+
+		image := ri.image
+
+		if ri.keep {
+			if c.dryrun {
+				fmt.Printf("Dry Run - Would have kept image: %s reason: %s\n", *image.ImageId, ri.reason)
+			} else if c.verbose {
+				fmt.Printf("Info - Not deregistering AMI: %s reason: %s\n", *image.ImageId, ri.reason)
 			}
+			continue
 		}
-	}
 
-	if len(snapshots) > 0 {
 		if c.verbose {
-			fmt.Printf("Waiting for AWS to break linkage between AMI & snapshot so snapshots can be deleted...\n")
+			fmt.Printf("Info - Deregistering AMI: %s reason: %s\n", *image.ImageId, ri.reason)
 		}
-		// pause a while to make sure AWS has broken link between AMI and snapshots so the snapshots can be deleted
+
 		if c.dryrun == false {
-			time.Sleep(12 * time.Second)
+			ec2dii := &ec2.DeregisterImageInput{
+				ImageId: image.ImageId, // Required
+			}
+
+			_, err = svc.DeregisterImage(ec2dii)
+
+			if err != nil {
+				fmt.Printf("error deregistering AMI %s. Image and snapshots not cleaned up. Error details\n%s\n",
+					*image.ImageId,
+					err)
+				// continue with next image
+				continue
+			}
+		} else {
+			fmt.Printf("Dry Run - Would have deregistered image: %s reason: %s\n", *image.ImageId, ri.reason)
+		}
+
+		for _, snapshotId := range imageSnapshots(image) {
+			if c.verbose {
+				fmt.Printf("Info - Will delete associated snapshot: %s from ami: %s\n", snapshotId, *image.ImageId)
+			}
+			snapshots = append(snapshots, snapshotId)
+		}
+		if c.verbose && c.dryrun == false {
+			fmt.Printf("Info - AMI: %s deregistered\n", *image.ImageId)
 		}
 	}
 
+	// AWS takes a while to break the link between a deregistered AMI and its snapshots
+	deadline := time.Now().Add(time.Duration(c.timeout) * time.Minute)
+
 	for _, snapshot := range snapshots {
 		if c.verbose {
 			fmt.Printf("Info - Deleting snapshot: %s.\n", snapshot)
 		}
 		if c.dryrun == false {
-			ec2dsi := ec2.DeleteSnapshotInput{SnapshotId: aws.String(snapshot)}
-			_, err = svc.DeleteSnapshot(&ec2dsi)
-
-			if err != nil {
-				fmt.Printf("error deleting snapshot %s. Snapshot has not been removed\n", snapshot)
+			if err = deleteSnapshot(svc, snapshot, deadline); err != nil {
+				fmt.Printf("error deleting snapshot %s. Snapshot has not been removed. Error details - %s\n", snapshot, err)
 			}
 		} else {
 			fmt.Printf("Dry Run - Would have removed snapshot: %s\n", snapshot)
 		}
 	}
 
-	if c.verbose {
-		fmt.Printf("All done.\n")
+	return imagesResp, rc
+}
+
+// protectInUse keeps the AMI's due for deletion that are still in use unless force was requested.
+// If the AMI's in use cannot be found every AMI is kept and an error code returned
+func (c *AMICommand) protectInUse(svc *ec2.EC2, decisions []*retainedBackup) int {
+
+	if c.force {
+		return RCOK
 	}
 
+	var candidates []*ec2.Image
+	for _, ri := range decisions {
+		if !ri.keep {
+			candidates = append(candidates, ri.image)
+		}
+	}
+
+	// shared AMI's are in use so only --force lets them be marked and their permissions revoked
+	inUse, err := imagesInUse(svc, candidates)
+	if err != nil {
+		fmt.Printf("Error - unable to check which AMI's are in use so none will be deleted. Error details - %s\n", err)
+	}
+
+	for _, ri := range decisions {
+		switch {
+		case ri.keep:
+		case err != nil:
+			ri.keep, ri.reason = true, "unable to check if in use"
+		case len(inUse[ri.id]) > 0:
+			ri.keep, ri.reason = true, inUse[ri.id]+". Use --force to delete"
+		}
+	}
+
+	if err != nil {
+		return RCERR
+	}
 	return RCOK
 }
 
+// imageDecisions decides which images to keep. In auto mode the retention policies apply and
+// a single AMI is only deleted if it has an autocleanup tag or is being retired
+func (c *AMICommand) imageDecisions(images []*ec2.Image) []*retainedBackup {
+
+	if c.autoMode() {
+		return retentionDecisions(retainedImages(images), c.policyBook, c.autoDays, c.keep, time.Now())
+	}
+
+	var decisions []*retainedBackup
+	for _, image := range images {
+		ri := &retainedBackup{id: *image.ImageId, image: image, tags: image.Tags, reason: "requested with -i"}
+		if c.retire {
+			ri.reason = "retired"
+		} else if len(tagValue(image.Tags, "autocleanup")) == 0 {
+			ri.keep, ri.reason = true, "no autocleanup tag"
+		}
+		decisions = append(decisions, ri)
+	}
+	return decisions
+}
+
+// autoMode reports if AMI's are selected by their autocleanup tag rather than by id
+func (c *AMICommand) autoMode() bool {
+	return c.autoDays > 0 || c.keep > 0 || len(c.policies) > 0
+}
+
+// cleanupVolumeSnapshots deletes the volume snapshots created by the snapshot command that the
+// retention policy does not keep. Snapshots are grouped by their source volume
+func (c *AMICommand) cleanupVolumeSnapshots(svc *ec2.EC2) int {
+
+	ec2dsi := ec2.DescribeSnapshotsInput{
+		OwnerIds: []*string{aws.String("self")},
+		Filters: []*ec2.Filter{
+			&ec2.Filter{
+				Name:   aws.String("tag-key"),
+				Values: []*string{aws.String("autocleanup")}},
+			&ec2.Filter{
+				Name:   aws.String("tag-key"),
+				Values: []*string{aws.String("autobkup-source-volume")}}}}
+
+	snapshots := make(map[string]*ec2.Snapshot)
+	var backups []*retainedBackup
+
+	err := svc.DescribeSnapshotsPages(&ec2dsi, func(p *ec2.DescribeSnapshotsOutput, lastPage bool) bool {
+		for _, snapshot := range p.Snapshots {
+			backup := &retainedBackup{
+				id:      *snapshot.SnapshotId,
+				tags:    snapshot.Tags,
+				created: aws.TimeValue(snapshot.StartTime),
+				group:   tagValue(snapshot.Tags, "autobkup-source-volume")}
+			if epoch, err := strconv.ParseInt(tagValue(snapshot.Tags, "autocleanup"), 10, 64); err == nil {
+				backup.created = time.Unix(epoch, 0)
+			}
+			snapshots[backup.id] = snapshot
+			backups = append(backups, backup)
+		}
+		return true
+	})
+
+	if err != nil {
+		fmt.Printf("Fatal error: %s\n", err)
+		return RCERR
+	}
+
+	rc := RCOK
+	deadline := time.Now().Add(time.Duration(c.timeout) * time.Minute)
+
+	decisions := retentionDecisions(backups, c.policyBook, c.autoDays, c.keep, time.Now())
+	exempt(decisions)
+
+	for _, backup := range decisions {
+
+		snapshot := snapshots[backup.id]
+
+		if backup.keep {
+			if _, pending := pendingDeleteSince(backup.tags); pending {
+				if err := clearPending(svc, []*string{snapshot.SnapshotId}, c.dryrun, c.verbose); err != nil {
+					fmt.Printf("error clearing pending-delete on snapshot %s. Error details - %s\n", backup.id, err)
+					rc = RCERR
+				}
+			}
+			if c.dryrun {
+				fmt.Printf("Dry Run - Would have kept volume snapshot: %s reason: %s\n", backup.id, backup.reason)
+			} else if c.verbose {
+				fmt.Printf("Info - Not deleting volume snapshot: %s reason: %s\n", backup.id, backup.reason)
+			}
+			continue
+		}
+
+		if c.grace > 0 {
+			ready, err := c.softDeleteSnapshot(svc, snapshot, time.Now())
+			if err != nil {
+				fmt.Printf("error marking snapshot %s pending-delete. Error details - %s\n", backup.id, err)
+				rc = RCERR
+			}
+			if !ready {
+				continue
+			}
+		}
+		if c.dryrun {
+			fmt.Printf("Dry Run - Would have removed volume snapshot: %s reason: %s\n", backup.id, backup.reason)
+			continue
+		}
+		if c.verbose {
+			fmt.Printf("Info - Deleting volume snapshot: %s of volume: %s reason: %s\n", backup.id, backup.group, backup.reason)
+		}
+		if err = deleteSnapshot(svc, backup.id, deadline); err != nil {
+			fmt.Printf("error deleting snapshot %s. Snapshot has not been removed. Error details - %s\n", backup.id, err)
+			rc = RCERR
+		}
+	}
+
+	return rc
+}
+
+// drRegions returns the DR regions named in the autobkup-dr-copy tags of the images
+// along with any regions provided as a comma separated list
+func drRegions(images []*ec2.Image, extra string) []string {
+
+	regions := make(map[string]bool)
+	for _, region := range splitIds(extra) {
+		regions[*region] = true
+	}
+
+	for _, image := range images {
+		for _, tag := range image.Tags {
+			if safeString(tag.Key) != "autobkup-dr-copy" {
+				continue
+			}
+			// the tag value is region/image id
+			if region := strings.SplitN(safeString(tag.Value), "/", 2)[0]; len(region) > 0 {
+				regions[region] = true
+			}
+		}
+	}
+
+	var sorted []string
+	for region := range regions {
+		sorted = append(sorted, region)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// deleteSnapshot deletes a snapshot, retrying while it is still in use by an AMI
+// that is being deregistered until the deadline has passed
+func deleteSnapshot(svc *ec2.EC2, snapshotId string, deadline time.Time) error {
+
+	ec2dsi := ec2.DeleteSnapshotInput{SnapshotId: aws.String(snapshotId)}
+
+	for {
+		_, err := svc.DeleteSnapshot(&ec2dsi)
+		if errorCode(err) != "InvalidSnapshot.InUse" || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
 /*
 
  */
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/mitchellh/cli"
+)
+
+type AMIShareCommand struct {
+	verbose  bool
+	dryrun   bool
+	csv      bool
+	automode bool
+	grant    bool
+	revoke   bool
+	report   bool
+	amiIds   string
+	accounts string
+	config   string
+	Ui       cli.Ui
+}
+
+// sharedImage holds the accounts an AMI and each of its snapshots are shared with
+type sharedImage struct {
+	imageId   string
+	name      string
+	public    bool
+	accounts  []string
+	snapshots map[string][]string
+}
+
+// Help function displays detailed help for the ami-share sub command
+func (c *AMIShareCommand) Help() string {
+	return `
+	Description:
+	Share AMI's and their snapshots with other accounts. Grant adds launch
+	permission on each AMI and create volume permission on each of its snapshots
+	for the accounts provided. Revoke removes them. The report shows who every
+	AMI and snapshot is shared with and marks accounts that are not in the
+	account list.
+
+	Usage:
+		awsgo-tools ami-share [flags]
+
+	Flags:
+	--grant - share the AMI's with the accounts
+	--revoke - stop sharing the AMI's with the accounts
+	--report - report current sharing. default when no other action is given
+	-a - select all AMI's owned by the account with a tag key of ami-share
+	-i <AMI Ids> - comma separated AMI's to share or report on
+	--accounts <ids> - comma separated account ids
+	--config <file> - file of account ids, one per line
+	-n - Dry Run. Report what would have been done but make no changes
+	-c - produce the report in csv format
+	-v - produce verbose output
+
+	The report covers every AMI owned by the account when no AMI's are selected.
+	`
+}
+
+// Synopsis function returns a string with concise details of the sub command
+func (c *AMIShareCommand) Synopsis() string {
+	return "Share AMI's & snapshots with other accounts"
+}
+
+// Run function is the function called by the cli library to run the actual sub command code.
+func (c *AMIShareCommand) Run(args []string) int {
+
+	cmdFlags := flag.NewFlagSet("ami-share", flag.ContinueOnError)
+	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+
+	cmdFlags.BoolVar(&c.grant, "grant", false, "Share the AMI's with the accounts")
+	cmdFlags.BoolVar(&c.revoke, "revoke", false, "Stop sharing the AMI's with the accounts")
+	cmdFlags.BoolVar(&c.report, "report", false, "Report current sharing")
+	cmdFlags.BoolVar(&c.automode, "a", false, "Select AMI's with a tag key of ami-share")
+	cmdFlags.StringVar(&c.amiIds, "i", "", "AMI's to share")
+	cmdFlags.StringVar(&c.accounts, "accounts", "", "Account ids to share with")
+	cmdFlags.StringVar(&c.config, "config", "", "File of account ids")
+	cmdFlags.BoolVar(&c.dryrun, "n", false, "Dry Run")
+	cmdFlags.BoolVar(&c.csv, "c", false, "Produce output in csv format")
+	cmdFlags.BoolVar(&c.verbose, "v", false, "Produce verbose output")
+	if err := cmdFlags.Parse(args); err != nil {
+		return RCERR
+	}
+
+	if c.grant && c.revoke {
+		fmt.Printf("Please choose one of --grant or --revoke\n")
+		return RCERR
+	}
+
+	accounts, err := loadAccounts(c.config, c.accounts)
+	if err != nil {
+		fmt.Printf("Fatal error: unable to load accounts - %s\n", err)
+		return RCERR
+	}
+
+	if (c.grant || c.revoke) && len(accounts) == 0 {
+		fmt.Printf("No accounts provided. Please provide accounts with --accounts or --config\n")
+		return RCERR
+	}
+
+	if (c.grant || c.revoke) && !c.automode && len(c.amiIds) == 0 {
+		fmt.Printf("No ami details provided. Please provide AMI's with -i or use -a to select tagged AMI's\n")
+		return RCERR
+	}
+
+	// Create an EC2 service object
+	// config values keys, sercet key & region read from environment
+	svc := ec2.New(session.New(), &aws.Config{MaxRetries: aws.Int(10)})
+
+	ec2dii := ec2.DescribeImagesInput{Owners: []*string{aws.String("self")}}
+
+	if len(c.amiIds) > 0 {
+		ec2dii.ImageIds = splitIds(c.amiIds)
+	} else if c.automode {
+		ec2dii.Filters = []*ec2.Filter{
+			&ec2.Filter{
+				Name:   aws.String("tag-key"),
+				Values: []*string{aws.String("ami-share")}}}
+	}
+
+	imagesResp, err := svc.DescribeImages(&ec2dii)
+	if err != nil {
+		fmt.Printf("Fatal error: %s\n", err)
+		return RCERR
+	}
+
+	if len(imagesResp.Images) == 0 {
+		if c.verbose {
+			fmt.Printf("No images found\n")
+		}
+		return RCOK
+	}
+
+	rc := RCOK
+
+	if c.grant || c.revoke {
+		for _, image := range imagesResp.Images {
+			if err := c.modifySharing(svc, image, accounts); err != nil {
+				fmt.Printf("Error changing sharing of AMI %s. Error details - %s\n", *image.ImageId, err)
+				rc = RCERR
+			}
+		}
+		if !c.report {
+			return rc
+		}
+	}
+
+	var shared []*sharedImage
+	for _, image := range imagesResp.Images {
+		si, err := imageSharing(svc, image)
+		if err != nil {
+			fmt.Printf("Error reading sharing of AMI %s. Error details - %s\n", *image.ImageId, err)
+			rc = RCERR
+			continue
+		}
+		shared = append(shared, si)
+	}
+
+	sort.Slice(shared, func(i, j int) bool { return shared[i].imageId < shared[j].imageId })
+	printSharing(shared, accounts, c.csv, c.verbose)
+
+	return rc
+}
+
+// modifySharing adds or removes launch permission on the AMI and create volume
+// permission on each of its snapshots for the accounts provided
+func (c *AMIShareCommand) modifySharing(svc *ec2.EC2, image *ec2.Image, accounts []string) error {
+
+	var launch []*ec2.LaunchPermission
+	var volume []*ec2.CreateVolumePermission
+	for _, account := range accounts {
+		launch = append(launch, &ec2.LaunchPermission{UserId: aws.String(account)})
+		volume = append(volume, &ec2.CreateVolumePermission{UserId: aws.String(account)})
+	}
+
+	action := "granted"
+	ec2miai := ec2.ModifyImageAttributeInput{
+		ImageId:          image.ImageId,
+		LaunchPermission: &ec2.LaunchPermissionModifications{Add: launch}}
+	if c.revoke {
+		action = "revoked"
+		ec2miai.LaunchPermission = &ec2.LaunchPermissionModifications{Remove: launch}
+	}
+
+	if c.dryrun {
+		fmt.Printf("Dry Run - Would have %s launch permission on AMI %s for %s\n", action, *image.ImageId, strings.Join(accounts, ","))
+	} else {
+		if _, err := svc.ModifyImageAttribute(&ec2miai); err != nil {
+			return err
+		}
+		if c.verbose {
+			fmt.Printf("Info - %s launch permission on AMI %s for %s\n", action, *image.ImageId, strings.Join(accounts, ","))
+		}
+	}
+
+	for _, snapshotId := range imageSnapshots(image) {
+
+		ec2msai := ec2.ModifySnapshotAttributeInput{
+			SnapshotId:             aws.String(snapshotId),
+			CreateVolumePermission: &ec2.CreateVolumePermissionModifications{Add: volume}}
+		if c.revoke {
+			ec2msai.CreateVolumePermission = &ec2.CreateVolumePermissionModifications{Remove: volume}
+		}
+
+		if c.dryrun {
+			fmt.Printf("Dry Run - Would have %s create volume permission on snapshot %s\n", action, snapshotId)
+			continue
+		}
+		if _, err := svc.ModifySnapshotAttribute(&ec2msai); err != nil {
+			return err
+		}
+		if c.verbose {
+			fmt.Printf("Info - %s create volume permission on snapshot %s\n", action, snapshotId)
+		}
+	}
+	return nil
+}
+
+// imageSharing reads the launch permissions of an AMI and the create volume permissions of its snapshots
+func imageSharing(svc *ec2.EC2, image *ec2.Image) (*sharedImage, error) {
+
+	si := &sharedImage{
+		imageId:   *image.ImageId,
+		name:      safeString(image.Name),
+		snapshots: make(map[string][]string)}
+
+	ec2diai := ec2.DescribeImageAttributeInput{
+		ImageId:   image.ImageId,
+		Attribute: aws.String(ec2.ImageAttributeNameLaunchPermission)}
+
+	attrResp, err := svc.DescribeImageAttribute(&ec2diai)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, perm := range attrResp.LaunchPermissions {
+		if safeString(perm.Group) == ec2.PermissionGroupAll {
+			si.public = true
+		} else if len(safeString(perm.UserId)) > 0 {
+			si.accounts = append(si.accounts, *perm.UserId)
+		}
+	}
+	sort.Strings(si.accounts)
+
+	for _, snapshotId := range imageSnapshots(image) {
+
+		ec2dsai := ec2.DescribeSnapshotAttributeInput{
+			SnapshotId: aws.String(snapshotId),
+			Attribute:  aws.String(ec2.SnapshotAttributeNameCreateVolumePermission)}
+
+		snapResp, err := svc.DescribeSnapshotAttribute(&ec2dsai)
+		if err != nil {
+			return nil, err
+		}
+
+		si.snapshots[snapshotId] = []string{}
+		for _, perm := range snapResp.CreateVolumePermissions {
+			if safeString(perm.Group) == ec2.PermissionGroupAll {
+				si.snapshots[snapshotId] = append(si.snapshots[snapshotId], "public")
+			} else if len(safeString(perm.UserId)) > 0 {
+				si.snapshots[snapshotId] = append(si.snapshots[snapshotId], *perm.UserId)
+			}
+		}
+		sort.Strings(si.snapshots[snapshotId])
+	}
+
+	return si, nil
+}
+
+// printSharing displays who each AMI and its snapshots are shared with. Accounts that are not
+// in the account list and snapshots shared differently to their AMI are marked
+func printSharing(shared []*sharedImage, accounts []string, csv bool, verbose bool) {
+
+	known := make(map[string]bool)
+	for _, account := range accounts {
+		known[account] = true
+	}
+
+	// note describes an account that is not in the account list when a list was provided
+	note := func(account string) string {
+		if len(known) > 0 && !known[account] && account != "public" {
+			return "not in account list"
+		}
+		return ""
+	}
+
+	if csv {
+		fmt.Printf("AMI, Name, Resource, Shared With, Note\n")
+	}
+
+	for _, si := range shared {
+
+		if !csv && (si.public || len(si.accounts) > 0 || verbose) {
+			fmt.Printf("\nAMI %s %s\n", si.imageId, si.name)
+		}
+
+		if si.public {
+			if csv {
+				fmt.Printf("%s,%s,%s,public,\n", si.imageId, si.name, si.imageId)
+			} else {
+				fmt.Printf("\tLaunch permission: public\n")
+			}
+		}
+
+		for _, account := range si.accounts {
+			if csv {
+				fmt.Printf("%s,%s,%s,%s,%s\n", si.imageId, si.name, si.imageId, account, note(account))
+			} else {
+				fmt.Printf("\tLaunch permission: %s %s\n", account, note(account))
+			}
+		}
+
+		var snapshotIds []string
+		for snapshotId := range si.snapshots {
+			snapshotIds = append(snapshotIds, snapshotId)
+		}
+		sort.Strings(snapshotIds)
+
+		for _, snapshotId := range snapshotIds {
+
+			// a snapshot shared differently to its AMI is usually left over from an earlier grant or revoke
+			if strings.Join(si.snapshots[snapshotId], ",") != strings.Join(si.accounts, ",") && !si.public {
+				if csv {
+					fmt.Printf("%s,%s,%s,,snapshot sharing differs from AMI\n", si.imageId, si.name, snapshotId)
+				} else {
+					fmt.Printf("\tSnapshot %s sharing differs from AMI\n", snapshotId)
+				}
+			}
+
+			for _, account := range si.snapshots[snapshotId] {
+				if csv {
+					fmt.Printf("%s,%s,%s,%s,%s\n", si.imageId, si.name, snapshotId, account, note(account))
+				} else if verbose || len(note(account)) > 0 || account == "public" {
+					fmt.Printf("\tSnapshot %s create volume permission: %s %s\n", snapshotId, account, note(account))
+				}
+			}
+		}
+	}
+}
+
+// imageSnapshots returns the snapshot ids in the block device mappings of an AMI
+func imageSnapshots(image *ec2.Image) (snapshotIds []string) {
+	for _, bdm := range image.BlockDeviceMappings {
+		if bdm.Ebs != nil && len(safeString(bdm.Ebs.SnapshotId)) > 0 {
+			snapshotIds = append(snapshotIds, *bdm.Ebs.SnapshotId)
+		}
+	}
+	return snapshotIds
+}
+
+// loadAccounts returns the account ids in the config file, one per line with # comments,
+// along with any in the comma separated list provided
+func loadAccounts(filename string, list string) ([]string, error) {
+
+	seen := make(map[string]bool)
+	var accounts []string
+
+	add := func(value string) {
+		for _, account := range splitIds(value) {
+			if !seen[*account] {
+				seen[*account] = true
+				accounts = append(accounts, *account)
+			}
+		}
+	}
+
+	add(list)
+
+	if len(filename) == 0 {
+		return accounts, nil
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		add(line)
+	}
+
+	return accounts, scanner.Err()
+}
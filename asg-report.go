@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/mitchellh/cli"
+)
+
+type ASGReportCommand struct {
+	header  bool
+	csv     bool
+	json    bool
+	days    int
+	ASGName string
+	Ui      cli.Ui
+}
+
+// asgFailure holds the details of a single failed or cancelled scaling activity
+type asgFailure struct {
+	StartTime     time.Time `json:"start_time"`
+	Description   string    `json:"description"`
+	StatusCode    string    `json:"status_code"`
+	StatusMessage string    `json:"status_message"`
+}
+
+// asgReport holds the capacity and scaling history of one auto scale group
+type asgReport struct {
+	Name             string       `json:"name"`
+	MinSize          int64        `json:"min_size"`
+	MaxSize          int64        `json:"max_size"`
+	MetricsEnabled   bool         `json:"metrics_enabled"`
+	ScaleOutEvents   int          `json:"scale_out_events"`
+	ScaleInEvents    int          `json:"scale_in_events"`
+	FailedLaunches   []asgFailure `json:"failed_launches"`
+	SecondsAtMax     int64        `json:"seconds_at_max"`
+	PeakInService    float64      `json:"peak_in_service"`
+	AverageInService float64      `json:"average_in_service"`
+	PeakDesired      float64      `json:"peak_desired"`
+	AverageDesired   float64      `json:"average_desired"`
+	ReportStartTime  time.Time    `json:"report_start_time"`
+	ReportEndTime    time.Time    `json:"report_end_time"`
+	MetricPeriod     int64        `json:"metric_period_seconds"`
+}
+
+// Help function displays detailed help for the asg-report sub command
+func (c *ASGReportCommand) Help() string {
+	return `
+	Description:
+	Report on auto scale group scaling activity and capacity history
+
+	Usage:
+		awsgo-tools asg-report [flags]
+
+	Flags:
+	--asg-name <auto scale group> - report on one group. default all groups
+	-d <days> - number of days of history to report on. default 7
+	-c - produce output in csv format
+	-j - produce output in json format including failed launch details
+	-h - print csv headers and exit
+	`
+}
+
+// Synopsis function returns a string with concise details of the sub command
+func (c *ASGReportCommand) Synopsis() string {
+	return "Auto scale group capacity & scaling history report"
+}
+
+// Run function is the function called by the cli library to run the actual sub command code.
+func (c *ASGReportCommand) Run(args []string) int {
+
+	cmdFlags := flag.NewFlagSet("asg-report", flag.ContinueOnError)
+	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+
+	cmdFlags.StringVar(&c.ASGName, "asg-name", "", "Auto scale group name or blank for all groups")
+	cmdFlags.IntVar(&c.days, "d", 7, "Number of days of history to report on")
+	cmdFlags.BoolVar(&c.csv, "c", false, "Produce output in csv format")
+	cmdFlags.BoolVar(&c.json, "j", false, "Produce output in json format")
+	cmdFlags.BoolVar(&c.header, "h", false, "Produce CSV Headers and exit")
+	if err := cmdFlags.Parse(args); err != nil {
+		return RCERR
+	}
+
+	if c.header {
+		fmt.Printf("ASG Name, Min Size, Max Size, Scale Out Events, Scale In Events, Failed Launches, Hours At Max, Peak In Service, Average In Service, Peak Desired, Average Desired\n")
+		return RCOK
+	}
+
+	if c.days < 1 {
+		fmt.Printf("Number of days must be greater than zero\n")
+		return RCERR
+	}
+
+	endTime := time.Now()
+	startTime := endTime.Add(-time.Duration(c.days) * 24 * time.Hour)
+
+	asgNames := []*string{}
+	if len(c.ASGName) > 0 {
+		asgNames = append(asgNames, &c.ASGName)
+	}
+
+	// Create an Autoscaling service object
+	// config values keys, sercet key & region read from environment
+	svcAs := autoscaling.New(session.New(), &aws.Config{MaxRetries: aws.Int(10)})
+
+	// Create a CloudWatch service object
+	// config values keys, sercet key & region read from environment
+	svcCw := cloudwatch.New(session.New(), &aws.Config{MaxRetries: aws.Int(10)})
+
+	var groups []*autoscaling.Group
+
+	asgi := autoscaling.DescribeAutoScalingGroupsInput{AutoScalingGroupNames: asgNames}
+	err := svcAs.DescribeAutoScalingGroupsPages(&asgi, func(p *autoscaling.DescribeAutoScalingGroupsOutput, lastPage bool) bool {
+		groups = append(groups, p.AutoScalingGroups...)
+		return true
+	})
+
+	if err != nil {
+		fmt.Printf("Fatal error: DescribeAutoScalingGroups - %s\n", err)
+		return RCERR
+	}
+
+	if len(groups) < 1 {
+		if len(c.ASGName) > 0 {
+			fmt.Printf("No Auto Scale Group info found for %s\n", c.ASGName)
+		} else {
+			fmt.Printf("No Auto Scale Groups found\n")
+		}
+		return RCOK
+	}
+
+	var reports []*asgReport
+
+	for _, group := range groups {
+
+		report, err := buildASGReport(svcAs, svcCw, group, startTime, endTime)
+		if err != nil {
+			fmt.Printf("Fatal error: unable to build report for %s - %s\n", *group.AutoScalingGroupName, err)
+			return RCERR
+		}
+		reports = append(reports, report)
+	}
+
+	switch {
+	case c.json:
+		out, err := json.MarshalIndent(reports, "", "  ")
+		if err != nil {
+			fmt.Printf("Fatal error: unable to produce json output - %s\n", err)
+			return RCERR
+		}
+		fmt.Printf("%s\n", out)
+	case c.csv:
+		for _, r := range reports {
+			fmt.Printf("%s,%d,%d,%d,%d,%d,%.1f,%.0f,%.2f,%.0f,%.2f\n",
+				r.Name,
+				r.MinSize,
+				r.MaxSize,
+				r.ScaleOutEvents,
+				r.ScaleInEvents,
+				len(r.FailedLaunches),
+				float64(r.SecondsAtMax)/3600,
+				r.PeakInService,
+				r.AverageInService,
+				r.PeakDesired,
+				r.AverageDesired)
+		}
+	default:
+		for _, r := range reports {
+			fmt.Printf("\nAuto Scale Group: %s (min %d max %d)\n", r.Name, r.MinSize, r.MaxSize)
+			fmt.Printf("Period: %s to %s\n", r.ReportStartTime.Format(time.RFC3339), r.ReportEndTime.Format(time.RFC3339))
+			fmt.Printf("Scale out events: %d\tScale in events: %d\n", r.ScaleOutEvents, r.ScaleInEvents)
+			if r.MetricsEnabled {
+				fmt.Printf("Time at max capacity: %.1f hours\n", float64(r.SecondsAtMax)/3600)
+				fmt.Printf("In service instances peak: %.0f\taverage: %.2f\n", r.PeakInService, r.AverageInService)
+				fmt.Printf("Desired capacity peak: %.0f\taverage: %.2f\n", r.PeakDesired, r.AverageDesired)
+			} else {
+				fmt.Printf("Group metrics collection is not enabled so no capacity history is available\n")
+			}
+			fmt.Printf("Failed launches: %d\n", len(r.FailedLaunches))
+			for _, f := range r.FailedLaunches {
+				fmt.Printf("  %s\t%s\t%s\n", f.StartTime.Format(time.RFC3339), f.StatusCode, f.StatusMessage)
+			}
+		}
+	}
+
+	return RCOK
+}
+
+// buildASGReport collects the scaling activities and capacity metrics for one auto scale group
+// between the start and end time and returns the summary
+func buildASGReport(svcAs *autoscaling.AutoScaling, svcCw *cloudwatch.CloudWatch, group *autoscaling.Group, startTime, endTime time.Time) (*asgReport, error) {
+
+	report := &asgReport{
+		Name:            *group.AutoScalingGroupName,
+		MinSize:         *group.MinSize,
+		MaxSize:         *group.MaxSize,
+		MetricsEnabled:  len(group.EnabledMetrics) > 0,
+		FailedLaunches:  []asgFailure{},
+		ReportStartTime: startTime,
+		ReportEndTime:   endTime,
+		MetricPeriod:    metricPeriod(startTime, endTime),
+	}
+
+	// activities are returned newest first so stop paging once past the start time
+	asdsai := autoscaling.DescribeScalingActivitiesInput{AutoScalingGroupName: group.AutoScalingGroupName}
+	err := svcAs.DescribeScalingActivitiesPages(&asdsai, func(p *autoscaling.DescribeScalingActivitiesOutput, lastPage bool) bool {
+		for _, activity := range p.Activities {
+			if activity.StartTime.Before(startTime) {
+				return false
+			}
+
+			launch := strings.HasPrefix(safeString(activity.Description), "Launching")
+
+			switch safeString(activity.StatusCode) {
+			case autoscaling.ScalingActivityStatusCodeFailed, autoscaling.ScalingActivityStatusCodeCancelled:
+				if launch {
+					report.FailedLaunches = append(report.FailedLaunches, asgFailure{
+						StartTime:     *activity.StartTime,
+						Description:   safeString(activity.Description),
+						StatusCode:    safeString(activity.StatusCode),
+						StatusMessage: safeString(activity.StatusMessage),
+					})
+				}
+			default:
+				if launch {
+					report.ScaleOutEvents++
+				} else if strings.HasPrefix(safeString(activity.Description), "Terminating") {
+					report.ScaleInEvents++
+				}
+			}
+		}
+		return true
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	// no point asking CloudWatch for group metrics that are not being collected
+	if !report.MetricsEnabled {
+		return report, nil
+	}
+
+	desired, err := asgMetric(svcCw, *group.AutoScalingGroupName, "GroupDesiredCapacity", startTime, endTime, report.MetricPeriod)
+	if err != nil {
+		return nil, err
+	}
+
+	inService, err := asgMetric(svcCw, *group.AutoScalingGroupName, "GroupInServiceInstances", startTime, endTime, report.MetricPeriod)
+	if err != nil {
+		return nil, err
+	}
+
+	report.PeakDesired, report.AverageDesired = peakAverage(desired)
+	report.PeakInService, report.AverageInService = peakAverage(inService)
+
+	for _, dp := range desired {
+		if dp.Maximum != nil && int64(*dp.Maximum) >= report.MaxSize {
+			report.SecondsAtMax += report.MetricPeriod
+		}
+	}
+
+	return report, nil
+}
+
+// asgMetric returns the datapoints for one of the auto scale group metrics
+func asgMetric(svc *cloudwatch.CloudWatch, asgName, metric string, startTime, endTime time.Time, period int64) ([]*cloudwatch.Datapoint, error) {
+
+	cwgmsi := cloudwatch.GetMetricStatisticsInput{
+		Namespace:  aws.String("AWS/AutoScaling"),
+		MetricName: aws.String(metric),
+		Dimensions: []*cloudwatch.Dimension{
+			&cloudwatch.Dimension{
+				Name:  aws.String("AutoScalingGroupName"),
+				Value: aws.String(asgName)}},
+		StartTime:  aws.Time(startTime),
+		EndTime:    aws.Time(endTime),
+		Period:     aws.Int64(period),
+		Statistics: []*string{aws.String("Average"), aws.String("Maximum")},
+	}
+
+	resp, err := svc.GetMetricStatistics(&cwgmsi)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Datapoints, nil
+}
+
+// peakAverage returns the highest Maximum and the mean of the Average values across the datapoints
+func peakAverage(datapoints []*cloudwatch.Datapoint) (peak float64, average float64) {
+
+	var total float64
+	var count int
+
+	for _, dp := range datapoints {
+		if dp.Maximum != nil && *dp.Maximum > peak {
+			peak = *dp.Maximum
+		}
+		if dp.Average != nil {
+			total += *dp.Average
+			count++
+		}
+	}
+
+	if count > 0 {
+		average = total / float64(count)
+	}
+	return peak, average
+}
+
+/*
+
+ */
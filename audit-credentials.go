@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/iam"
+)
+
+// rootUser is the user name of the root account in the credential report
+const rootUser = "<root_account>"
+
+// credentialReportCheck flags risky credentials from the IAM credential report
+type credentialReportCheck struct{}
+
+func (r *credentialReportCheck) ID() string         { return "credential-report" }
+func (r *credentialReportCheck) Title() string      { return "IAM credential report" }
+func (r *credentialReportCheck) Severity() severity { return severityCritical }
+
+// Run function generates the IAM credential report and returns a finding for each risky credential
+func (r *credentialReportCheck) Run(options auditOptions) ([]*finding, error) {
+
+	// Create an IAM service object
+	// Config details Keys, secret keys and region will be read from environment
+	svc := iam.New(session.New(), &aws.Config{MaxRetries: aws.Int(10)})
+
+	content, err := credentialReport(svc, time.Minute)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := parseCredentialReport(content)
+	if err != nil {
+		return nil, err
+	}
+
+	return credentialFindings(rows, time.Now(), options), nil
+}
+
+// credentialReport generates the IAM credential report and returns its csv content. It waits
+// up to the timeout for the report to be generated
+func credentialReport(svc *iam.IAM, timeout time.Duration) ([]byte, error) {
+
+	deadline := time.Now().Add(timeout)
+
+	for {
+		genResp, err := svc.GenerateCredentialReport(&iam.GenerateCredentialReportInput{})
+		if err != nil {
+			return nil, err
+		}
+		if safeString(genResp.State) == iam.ReportStateTypeComplete {
+			break
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("credential report not generated within %s", timeout)
+		}
+		time.Sleep(2 * time.Second)
+	}
+
+	reportResp, err := svc.GetCredentialReport(&iam.GetCredentialReportInput{})
+	if err != nil {
+		return nil, err
+	}
+	return reportResp.Content, nil
+}
+
+// parseCredentialReport returns each row of the credential report keyed by column name
+func parseCredentialReport(content []byte) ([]map[string]string, error) {
+
+	records, err := csv.NewReader(bytes.NewReader(content)).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("credential report: %s", err)
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	header := records[0]
+	var rows []map[string]string
+	for _, record := range records[1:] {
+		row := make(map[string]string)
+		for i, value := range record {
+			if i < len(header) {
+				row[header[i]] = value
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// credentialFindings returns the findings for the credential report rows. The key-max-age,
+// password-max-unused and root-usage-days options set the limits in days
+func credentialFindings(rows []map[string]string, now time.Time, options auditOptions) []*finding {
+
+	keyMaxAge := options.int("key-max-age", 90)
+	passwordMaxUnused := options.int("password-max-unused", 90)
+	rootUsageDays := options.int("root-usage-days", 30)
+
+	var findings []*finding
+	add := func(sev severity, user string, message string, details map[string]string) {
+		findings = append(findings, &finding{
+			Check:        "credential-report",
+			Severity:     sev,
+			ResourceType: "user",
+			ResourceId:   user,
+			Message:      message,
+			Details:      details})
+	}
+
+	for _, row := range rows {
+
+		user := row["user"]
+		passwordEnabled := row["password_enabled"] == "true"
+
+		if user == rootUser {
+			if row["mfa_active"] != "true" {
+				add(severityCritical, user, "root account has no MFA", nil)
+			}
+			for _, key := range []string{"access_key_1", "access_key_2"} {
+				if row[key+"_active"] == "true" {
+					add(severityCritical, user, "root account has an active access key", map[string]string{"key": key})
+				}
+			}
+			for _, column := range []string{"password_last_used", "access_key_1_last_used_date", "access_key_2_last_used_date"} {
+				if used, ok := reportTime(row[column]); ok && now.Sub(used) < days(rootUsageDays) {
+					add(severityHigh, user, fmt.Sprintf("root account used %s (%s)", used.UTC().Format(time.RFC3339), column),
+						map[string]string{column: row[column]})
+				}
+			}
+			continue
+		}
+
+		if passwordEnabled && row["mfa_active"] != "true" {
+			add(severityHigh, user, "console user has no MFA", nil)
+		}
+
+		// a password never used counts from when it was set
+		if passwordEnabled {
+			lastUsed, ok := reportTime(row["password_last_used"])
+			if !ok {
+				lastUsed, ok = reportTime(row["password_last_changed"])
+			}
+			if ok && now.Sub(lastUsed) > days(passwordMaxUnused) {
+				add(severityMedium, user, fmt.Sprintf("password unused for %.0f days", now.Sub(lastUsed).Hours()/24),
+					map[string]string{"password_last_used": row["password_last_used"]})
+			}
+		}
+
+		active := 0
+		for _, key := range []string{"access_key_1", "access_key_2"} {
+
+			if row[key+"_active"] != "true" {
+				continue
+			}
+			active++
+
+			details := map[string]string{
+				"key":            key,
+				"last_rotated":   row[key+"_last_rotated"],
+				"last_used_date": row[key+"_last_used_date"]}
+
+			rotated, ok := reportTime(row[key+"_last_rotated"])
+			if ok && now.Sub(rotated) > days(keyMaxAge) {
+				add(severityMedium, user, fmt.Sprintf("%s is %.0f days old", key, now.Sub(rotated).Hours()/24), details)
+			}
+			if _, used := reportTime(row[key+"_last_used_date"]); !used {
+				add(severityLow, user, fmt.Sprintf("%s has never been used", key), details)
+			}
+		}
+
+		if active > 1 {
+			add(severityMedium, user, "user has two active access keys", nil)
+		}
+	}
+	return findings
+}
+
+// reportTime parses a credential report time. Values such as N/A and no_information are not times
+func reportTime(value string) (time.Time, bool) {
+	t, err := time.Parse(time.RFC3339, value)
+	return t, err == nil
+}
+
+// days returns the duration of a number of days
+func days(n int) time.Duration {
+	return time.Duration(n) * 24 * time.Hour
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// defaultSensitivePorts are the ports that should not be open to the internet unless set with
+// the sensitive-ports option
+const defaultSensitivePorts = "21,22,23,135,139,445,1433,1521,2375,2379,3306,3389,5432,5900,5984,6379,7000,8020,9042,9200,9300,11211,27017"
+
+// openSecurityGroupCheck finds security group rules that open sensitive ports to 0.0.0.0/0
+type openSecurityGroupCheck struct{}
+
+func (o *openSecurityGroupCheck) ID() string         { return "open-security-groups" }
+func (o *openSecurityGroupCheck) Title() string      { return "Security groups open to the internet" }
+func (o *openSecurityGroupCheck) Severity() severity { return severityCritical }
+
+// Run function returns a finding for each security group rule that opens all ports or a
+// sensitive port to 0.0.0.0/0. The network interfaces in the group show what is exposed.
+// Rules in groups with a public ip attached are critical for all ports and high for a
+// sensitive port, in groups without a public ip they are medium and in unused groups low
+func (o *openSecurityGroupCheck) Run(options auditOptions) ([]*finding, error) {
+
+	ports := make(map[int64]bool)
+	for _, port := range splitIds(options.string("sensitive-ports", defaultSensitivePorts)) {
+		p, err := strconv.ParseInt(*port, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sensitive port %q", *port)
+		}
+		ports[p] = true
+	}
+
+	// Create an EC2 service object
+	// config values keys, sercet key & region read from environment
+	svc := ec2.New(session.New(), &aws.Config{MaxRetries: aws.Int(10)})
+
+	exposed, public, err := groupExposure(svc)
+	if err != nil {
+		return nil, err
+	}
+
+	sgResp, err := svc.DescribeSecurityGroups(&ec2.DescribeSecurityGroupsInput{})
+	if err != nil {
+		return nil, err
+	}
+
+	var findings []*finding
+
+	for _, group := range sgResp.SecurityGroups {
+
+		groupId := safeString(group.GroupId)
+
+		for _, perm := range group.IpPermissions {
+
+			if !openToInternet(perm) {
+				continue
+			}
+
+			var opened string
+			allPorts := safeString(perm.IpProtocol) == "-1" ||
+				(aws.Int64Value(perm.FromPort) <= 0 && aws.Int64Value(perm.ToPort) >= 65535)
+			if allPorts {
+				opened = "all ports"
+			} else {
+				open := sensitiveInRange(ports, aws.Int64Value(perm.FromPort), aws.Int64Value(perm.ToPort))
+				if len(open) == 0 {
+					continue
+				}
+				opened = safeString(perm.IpProtocol) + " port " + strings.Join(open, ",")
+			}
+
+			sev := severityLow
+			usage := "group is not in use"
+			switch {
+			case public[groupId] && allPorts:
+				sev, usage = severityCritical, "exposed "+strings.Join(exposed[groupId], ", ")
+			case public[groupId]:
+				sev, usage = severityHigh, "exposed "+strings.Join(exposed[groupId], ", ")
+			case len(exposed[groupId]) > 0:
+				sev, usage = severityMedium, "no public ip on "+strings.Join(exposed[groupId], ", ")
+			}
+
+			findings = append(findings, &finding{
+				Check:        o.ID(),
+				Severity:     sev,
+				ResourceType: "security-group",
+				ResourceId:   groupId,
+				Message:      fmt.Sprintf("%s (%s) opens %s to 0.0.0.0/0. %s", safeString(group.GroupName), safeString(group.VpcId), opened, usage),
+				Details: map[string]string{
+					"group_name": safeString(group.GroupName),
+					"vpc_id":     safeString(group.VpcId),
+					"opened":     opened,
+					"exposed":    strings.Join(exposed[groupId], ";")}})
+		}
+	}
+	return findings, nil
+}
+
+// openToInternet reports if the rule allows traffic from 0.0.0.0/0
+func openToInternet(perm *ec2.IpPermission) bool {
+	for _, ipRange := range perm.IpRanges {
+		if safeString(ipRange.CidrIp) == "0.0.0.0/0" {
+			return true
+		}
+	}
+	return false
+}
+
+// sensitiveInRange returns the sensitive ports from one port to another, sorted
+func sensitiveInRange(ports map[int64]bool, from, to int64) []string {
+	var open []int64
+	for port := range ports {
+		if port >= from && port <= to {
+			open = append(open, port)
+		}
+	}
+	sort.Slice(open, func(i, j int) bool { return open[i] < open[j] })
+
+	var names []string
+	for _, port := range open {
+		names = append(names, strconv.FormatInt(port, 10))
+	}
+	return names
+}
+
+// groupExposure returns what uses each security group from the network interfaces in the group,
+// and the groups with a public ip on at least one of their network interfaces
+func groupExposure(svc *ec2.EC2) (map[string][]string, map[string]bool, error) {
+
+	eniResp, err := svc.DescribeNetworkInterfaces(&ec2.DescribeNetworkInterfacesInput{})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	exposed := make(map[string][]string)
+	public := make(map[string]bool)
+
+	for _, eni := range eniResp.NetworkInterfaces {
+
+		user := interfaceUser(eni)
+		if eni.Association != nil && len(safeString(eni.Association.PublicIp)) > 0 {
+			user += " " + *eni.Association.PublicIp
+		}
+
+		for _, group := range eni.Groups {
+			groupId := safeString(group.GroupId)
+			exposed[groupId] = append(exposed[groupId], user)
+			if eni.Association != nil && len(safeString(eni.Association.PublicIp)) > 0 {
+				public[groupId] = true
+			}
+		}
+	}
+
+	for _, users := range exposed {
+		sort.Strings(users)
+	}
+	return exposed, public, nil
+}
+
+// interfaceUser describes what a network interface belongs to such as an instance, ELB or RDS
+func interfaceUser(eni *ec2.NetworkInterface) string {
+
+	description := safeString(eni.Description)
+
+	switch {
+	case eni.Attachment != nil && len(safeString(eni.Attachment.InstanceId)) > 0:
+		return "instance " + *eni.Attachment.InstanceId
+	case strings.HasPrefix(description, "ELB "):
+		return "elb " + strings.TrimPrefix(description, "ELB ")
+	case safeString(eni.RequesterId) == "amazon-rds" || description == "RDSNetworkInterface":
+		return "rds " + safeString(eni.NetworkInterfaceId)
+	case len(description) > 0:
+		return "eni " + safeString(eni.NetworkInterfaceId) + " (" + description + ")"
+	}
+	return "eni " + safeString(eni.NetworkInterfaceId)
+}
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -12,15 +17,105 @@ import (
 )
 
 type AuditCommand struct {
-	verbose    bool
-	csv        bool
-	all        bool
-	public_ami bool
-	users      bool
-	snapshots  bool
-	Ui         cli.Ui
+	verbose     bool
+	csv         bool
+	json        bool
+	list        bool
+	all         bool
+	public_ami  bool
+	users       bool
+	snapshots   bool
+	checks      string
+	exclude     string
+	minSeverity string
+	options     string
+	Ui          cli.Ui
 }
 
+// severity ranks how serious a finding is
+type severity int
+
+const (
+	severityInfo severity = iota
+	severityLow
+	severityMedium
+	severityHigh
+	severityCritical
+)
+
+var severityNames = []string{"info", "low", "medium", "high", "critical"}
+
+// String returns the name of the severity
+func (s severity) String() string {
+	if int(s) < len(severityNames) {
+		return severityNames[s]
+	}
+	return strconv.Itoa(int(s))
+}
+
+// MarshalJSON writes the severity by name
+func (s severity) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// parseSeverity returns the severity with the name provided
+func parseSeverity(name string) (severity, error) {
+	for i, n := range severityNames {
+		if strings.EqualFold(n, name) {
+			return severity(i), nil
+		}
+	}
+	return severityInfo, fmt.Errorf("unknown severity %q. Expected one of %s", name, strings.Join(severityNames, ","))
+}
+
+// finding is one problem or observation reported by an audit check
+type finding struct {
+	Check        string            `json:"check"`
+	Severity     severity          `json:"severity"`
+	ResourceType string            `json:"resource_type"`
+	ResourceId   string            `json:"resource_id"`
+	Message      string            `json:"message"`
+	Details      map[string]string `json:"details,omitempty"`
+}
+
+// auditOptions holds the check settings provided with --options as key=value pairs
+type auditOptions map[string]string
+
+// int returns the option as a number or the default if it is not set or not a number
+func (o auditOptions) int(key string, def int) int {
+	if value, err := strconv.Atoi(o[key]); err == nil {
+		return value
+	}
+	return def
+}
+
+// string returns the option or the default if it is not set
+func (o auditOptions) string(key string, def string) string {
+	if value, ok := o[key]; ok {
+		return value
+	}
+	return def
+}
+
+// auditCheck is one audit. Run returns the findings of the check. The severity of a check is
+// the most serious severity its findings can have and is used to select checks to run
+type auditCheck interface {
+	ID() string
+	Title() string
+	Severity() severity
+	Run(options auditOptions) ([]*finding, error)
+}
+
+// auditChecks is the registry of every audit check in the order they run
+var auditChecks = []auditCheck{
+	&publicAMICheck{},
+	&usersCheck{},
+	&snapshotsCheck{},
+	&openSecurityGroupCheck{},
+	&credentialReportCheck{},
+}
+
+// Help function displays detailed help for the audit sub command
 func (c *AuditCommand) Help() string {
 	return `
 	Description:
@@ -31,18 +126,31 @@ func (c *AuditCommand) Help() string {
 
 	Flags:
 	-v - produce verbose output
-	--csv - produce output in csv format if possible
+	--csv - produce output in csv format
+	--json - produce output as one json finding per line
+	--list - list the audit checks and exit
+	--check <ids> - comma separated ids of the checks to run. default all
+	--exclude <ids> - comma separated ids of checks not to run
+	--min-severity <level> - only run checks and report findings of at least
+		this severity. info, low, medium, high or critical. default info
+	--options <key=value;...> - settings for the checks
+		sensitive-ports=<ports> - comma separated ports open-security-groups flags
+		key-max-age=<days> - credential-report access key age limit. default 90
+		password-max-unused=<days> - credential-report password unused limit. default 90
+		root-usage-days=<days> - credential-report flags root use this recent. default 30
 	--all - run all the audit checks
-	--public_ami - check for AMI's owned by account but with public visibility
-	--users - show password & access key last used details
-	--snapshots - show snapshots that are not associated with an AMI
+	--public_ami - same as --check public-ami
+	--users - same as --check users. credential-report covers users faster
+	--snapshots - same as --check snapshots
 	`
 }
 
+// Synopsis function returns a string with concise details of the sub command
 func (c *AuditCommand) Synopsis() string {
 	return "Audit various AWS services"
 }
 
+// Run function is the function called by the cli library to run the actual sub command code.
 func (c *AuditCommand) Run(args []string) int {
 
 	cmdFlags := flag.NewFlagSet("audit", flag.ContinueOnError)
@@ -50,6 +158,12 @@ func (c *AuditCommand) Run(args []string) int {
 
 	cmdFlags.BoolVar(&c.verbose, "v", false, "Produce verbose output")
 	cmdFlags.BoolVar(&c.csv, "csv", false, "Produce output in csv format")
+	cmdFlags.BoolVar(&c.json, "json", false, "Produce output in json format")
+	cmdFlags.BoolVar(&c.list, "list", false, "List the audit checks")
+	cmdFlags.StringVar(&c.checks, "check", "", "Audit checks to run")
+	cmdFlags.StringVar(&c.exclude, "exclude", "", "Audit checks not to run")
+	cmdFlags.StringVar(&c.minSeverity, "min-severity", "info", "Minimum severity to report")
+	cmdFlags.StringVar(&c.options, "options", "", "Settings for the audit checks")
 	cmdFlags.BoolVar(&c.all, "all", false, "Select all Audit options")
 	cmdFlags.BoolVar(&c.public_ami, "public_ami", false, "Audit AMI's for public launch permissions")
 	cmdFlags.BoolVar(&c.users, "users", false, "Audit Users password & AccessKey last used")
@@ -58,28 +172,159 @@ func (c *AuditCommand) Run(args []string) int {
 		return RCERR
 	}
 
-	if c.public_ami == true || c.all == true {
-		public_ami(c.verbose, c.csv)
+	if c.list {
+		listChecks()
+		return RCOK
+	}
+
+	minSeverity, err := parseSeverity(c.minSeverity)
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		return RCERR
+	}
+
+	options, err := parseAuditOptions(c.options)
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		return RCERR
 	}
 
-	if c.users == true || c.all == true {
-		users(c.verbose, c.csv)
+	checks, err := c.selectChecks(minSeverity)
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		return RCERR
 	}
 
-	if c.snapshots == true || c.all == true {
-		snapshots(c.verbose, c.csv)
+	rc := RCOK
+	var findings []*finding
+
+	for _, check := range checks {
+		if c.verbose {
+			fmt.Printf("#### Begin Audit: %s ####\n", check.Title())
+		}
+
+		checkFindings, err := check.Run(options)
+		if err != nil {
+			fmt.Printf("Audit check %s failed: %s\n", check.ID(), err)
+			rc = RCERR
+		}
+
+		for _, f := range checkFindings {
+			if f.Severity >= minSeverity {
+				findings = append(findings, f)
+			}
+		}
+
+		if c.verbose {
+			fmt.Printf("#### Audit Complete: %d findings ####\n", len(checkFindings))
+		}
 	}
 
-	return RCOK
+	reportFindings(findings, c.csv, c.json)
+
+	return rc
 }
 
-// public_ami function displays any AMI that has public launch permissions
-func public_ami(verbose bool, csv bool) {
+// selectChecks returns the registered checks chosen with the check and exclude flags, or with
+// the older per check flags, whose severity is at least the minimum
+func (c *AuditCommand) selectChecks(minSeverity severity) ([]auditCheck, error) {
 
-	if verbose == true {
-		fmt.Printf("#### Begin Audit of Public AMI Launch Permissions ####\n")
+	selected := make(map[string]bool)
+	for _, id := range splitIds(c.checks) {
+		selected[*id] = true
+	}
+	for id, set := range map[string]bool{"public-ami": c.public_ami, "users": c.users, "snapshots": c.snapshots} {
+		if set {
+			selected[id] = true
+		}
+	}
+	excluded := make(map[string]bool)
+	for _, id := range splitIds(c.exclude) {
+		excluded[*id] = true
 	}
 
+	known := make(map[string]bool)
+	for _, check := range auditChecks {
+		known[check.ID()] = true
+	}
+	for id := range selected {
+		if !known[id] {
+			return nil, fmt.Errorf("unknown audit check %q. Use --list to see the checks", id)
+		}
+	}
+
+	var checks []auditCheck
+	for _, check := range auditChecks {
+		switch {
+		case len(selected) > 0 && !c.all && !selected[check.ID()]:
+		case excluded[check.ID()]:
+		case check.Severity() < minSeverity:
+		default:
+			checks = append(checks, check)
+		}
+	}
+	return checks, nil
+}
+
+// parseAuditOptions reads check settings in the form key=value;key=value
+func parseAuditOptions(value string) (auditOptions, error) {
+
+	options := make(auditOptions)
+	for _, field := range strings.Split(value, ";") {
+		field = strings.TrimSpace(field)
+		if len(field) == 0 {
+			continue
+		}
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid option %q. Expected key=value", field)
+		}
+		options[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return options, nil
+}
+
+// listChecks displays the id, severity and title of each registered check
+func listChecks() {
+	for _, check := range auditChecks {
+		fmt.Printf("%-20s %-9s %s\n", check.ID(), check.Severity(), check.Title())
+	}
+}
+
+// reportFindings displays the findings sorted by severity, most serious first
+func reportFindings(findings []*finding, csv bool, asJson bool) {
+
+	sort.SliceStable(findings, func(i, j int) bool { return findings[i].Severity > findings[j].Severity })
+
+	switch {
+	case asJson:
+		enc := json.NewEncoder(os.Stdout)
+		for _, f := range findings {
+			enc.Encode(f)
+		}
+	case csv:
+		fmt.Printf("Check, Severity, Resource Type, Resource Id, Message\n")
+		for _, f := range findings {
+			fmt.Printf("%s,%s,%s,%s,%q\n", f.Check, f.Severity, f.ResourceType, f.ResourceId, f.Message)
+		}
+	default:
+		for _, f := range findings {
+			fmt.Printf("[%s] %s %s %s: %s\n", strings.ToUpper(f.Severity.String()), f.Check, f.ResourceType, f.ResourceId, f.Message)
+		}
+		fmt.Printf("A total of %d findings\n", len(findings))
+	}
+}
+
+// publicAMICheck finds AMI's owned by the account with public launch permissions
+type publicAMICheck struct{}
+
+func (p *publicAMICheck) ID() string         { return "public-ami" }
+func (p *publicAMICheck) Title() string      { return "AMI's with public launch permissions" }
+func (p *publicAMICheck) Severity() severity { return severityHigh }
+
+// Run function returns a finding for each AMI that has public launch permissions
+func (p *publicAMICheck) Run(options auditOptions) ([]*finding, error) {
+
 	// Create an EC2 service object
 	// config values keys, sercet key & region read from environment
 	svc := ec2.New(session.New(), &aws.Config{MaxRetries: aws.Int(10)})
@@ -87,105 +332,103 @@ func public_ami(verbose bool, csv bool) {
 	ec2dii := ec2.DescribeImagesInput{Owners: []*string{aws.String("self")}}
 
 	imagesResp, err := svc.DescribeImages(&ec2dii)
-
 	if err != nil {
-		fmt.Printf("AWS Error: %s\n", err)
-		return
+		return nil, err
 	}
 
+	var findings []*finding
 	for _, image := range imagesResp.Images {
-		if *image.Public == true {
-			fmt.Printf("AMI %s has Public launch permissions\n", *image.ImageId)
+		if aws.BoolValue(image.Public) {
+			findings = append(findings, &finding{
+				Check:        p.ID(),
+				Severity:     severityHigh,
+				ResourceType: "ami",
+				ResourceId:   *image.ImageId,
+				Message:      "AMI has public launch permissions. Use ami-share --report for AMI's shared with other accounts"})
 		}
-
 	}
+	return findings, nil
+}
 
-	if verbose == true {
-		fmt.Printf("#### Audit Complete ####\n")
-	}
+// usersCheck reports when each user last used their password and access keys
+type usersCheck struct{}
 
-	return
+func (u *usersCheck) ID() string         { return "users" }
+func (u *usersCheck) Title() string      { return "User password & access key last used" }
+func (u *usersCheck) Severity() severity { return severityInfo }
 
-}
+// Run function returns a finding with the last used details of each user password and access key
+func (u *usersCheck) Run(options auditOptions) ([]*finding, error) {
 
-// users function will display details on all users and last used info on passwords
-// and access keys
-func users(verbose bool, csv bool) {
-
-	// ListUsers to get a list of all users on the account. Check truncated
 	// Create an IAM service object
 	// Config details Keys, secret keys and region will be read from environment
 	svc := iam.New(session.New(), &aws.Config{MaxRetries: aws.Int(10)})
 
-	iamlui := &iam.ListUsersInput{
-		Marker:     nil,
-		MaxItems:   nil,
-		PathPrefix: nil,
-	}
-
-	var dowhile bool = true
+	var findings []*finding
+	var keyErr error
 
-	// for each user returned record password last used time
-	for dowhile == true {
-
-		iamluo, err := svc.ListUsers(iamlui)
-		if err != nil {
-			fmt.Printf("Fatal error: ListUsers - %s\n", err)
-			return
-		}
-
-		if *iamluo.IsTruncated == false {
-			dowhile = false
-		}
-		iamlui.Marker = iamluo.Marker
+	err := svc.ListUsersPages(&iam.ListUsersInput{}, func(p *iam.ListUsersOutput, lastPage bool) bool {
 
 		// loop over each user account in IAM
-		for _, user := range iamluo.Users {
-
-			iamlaki := &iam.ListAccessKeysInput{
-				UserName: user.UserName,
-			}
+		for _, user := range p.Users {
 
-			fmt.Printf("\nUsername: %s\nPassword Last Used: %s\n",
-				*user.UserName,
-				safeDateString(user.PasswordLastUsed))
+			findings = append(findings, &finding{
+				Check:        u.ID(),
+				Severity:     severityInfo,
+				ResourceType: "user",
+				ResourceId:   *user.UserName,
+				Message:      "password last used " + safeDateString(user.PasswordLastUsed),
+				Details:      map[string]string{"password_last_used": safeDateString(user.PasswordLastUsed)}})
 
-			iamlako, err := svc.ListAccessKeys(iamlaki)
+			iamlako, err := svc.ListAccessKeys(&iam.ListAccessKeysInput{UserName: user.UserName})
 			if err != nil {
-				fmt.Printf("AWS Error: %s\n", err)
-				return
+				keyErr = err
+				return false
 			}
 
 			// loop over each access key for the user
 			for _, accesskey := range iamlako.AccessKeyMetadata {
 
-				iamgaklui := &iam.GetAccessKeyLastUsedInput{
-					AccessKeyId: accesskey.AccessKeyId,
-				}
-
-				iamgakluo, err := svc.GetAccessKeyLastUsed(iamgaklui)
-
+				iamgakluo, err := svc.GetAccessKeyLastUsed(&iam.GetAccessKeyLastUsedInput{AccessKeyId: accesskey.AccessKeyId})
 				if err != nil {
-					fmt.Printf("AWS Error: %s\n", err)
-					return
+					keyErr = err
+					return false
 				}
 
-				fmt.Printf("AccessKey: %s\nStatus: %s\nDate Last Used: %s\nRegion: %s\nService: %s\n",
-					*accesskey.AccessKeyId,
-					*accesskey.Status,
-					safeDateString(iamgakluo.AccessKeyLastUsed.LastUsedDate),
-					safeString(iamgakluo.AccessKeyLastUsed.Region),
-					safeString(iamgakluo.AccessKeyLastUsed.ServiceName))
+				lastUsed := iamgakluo.AccessKeyLastUsed
+				findings = append(findings, &finding{
+					Check:        u.ID(),
+					Severity:     severityInfo,
+					ResourceType: "access-key",
+					ResourceId:   *accesskey.AccessKeyId,
+					Message: fmt.Sprintf("user %s key %s last used %s in %s by %s", *user.UserName, safeString(accesskey.Status),
+						safeDateString(lastUsed.LastUsedDate), safeString(lastUsed.Region), safeString(lastUsed.ServiceName)),
+					Details: map[string]string{
+						"user":           *user.UserName,
+						"status":         safeString(accesskey.Status),
+						"last_used_date": safeDateString(lastUsed.LastUsedDate),
+						"region":         safeString(lastUsed.Region),
+						"service":        safeString(lastUsed.ServiceName)}})
 			}
 		}
+		return true
+	})
 
+	if err == nil {
+		err = keyErr
 	}
-
-	return
+	return findings, err
 }
 
-// snapshots function displays any snapshot that is not associated with an AMI
-func snapshots(verbose bool, csv bool) {
+// snapshotsCheck finds snapshots that are not associated with an AMI owned by the account
+type snapshotsCheck struct{}
+
+func (s *snapshotsCheck) ID() string         { return "snapshots" }
+func (s *snapshotsCheck) Title() string      { return "Snapshots not associated with an AMI" }
+func (s *snapshotsCheck) Severity() severity { return severityLow }
+
+// Run function returns a finding for each snapshot not associated with an AMI
+func (s *snapshotsCheck) Run(options auditOptions) ([]*finding, error) {
 
 	// Create an EC2 service object
 	// config values keys, sercet key & region read from environment
@@ -193,63 +436,37 @@ func snapshots(verbose bool, csv bool) {
 
 	owners := []*string{aws.String("self")}
 
-	ec2dssi := ec2.DescribeSnapshotsInput{OwnerIds: owners}
-
-	resp, err := svc.DescribeSnapshots(&ec2dssi)
-
-	if err != nil {
-		fmt.Printf("Fatal error: %s\n", err)
-		return
-	}
-
-	if len(resp.Snapshots) == 0 {
-		fmt.Printf("No Snapshots found for this account\n")
-		return
-	}
-
-	ssm := make(map[string]string, len(resp.Snapshots))
-
-	// fill the map with a key of each snapshot you own
-	for _, ss := range resp.Snapshots {
-		ssm[*ss.SnapshotId] = *ss.Description
-	}
-
 	// Find all the account ami's
-	ec2dii := ec2.DescribeImagesInput{Owners: owners}
-
-	imagesResp, err := svc.DescribeImages(&ec2dii)
-
+	imagesResp, err := svc.DescribeImages(&ec2.DescribeImagesInput{Owners: owners})
 	if err != nil {
-		fmt.Printf("Fatal error: %s\n", err)
-		return
+		return nil, err
 	}
 
+	inImage := make(map[string]bool)
 	for _, image := range imagesResp.Images {
-		for _, blockDM := range image.BlockDeviceMappings {
-
-			if blockDM.Ebs != nil {
-				// remove this snapshot reference as it is associated with an AMI
-				delete(ssm, *blockDM.Ebs.SnapshotId)
-			}
+		for _, snapshotId := range imageSnapshots(image) {
+			inImage[snapshotId] = true
 		}
-
 	}
 
-	if verbose == true {
-		fmt.Printf("\nSnapshots not associated with an AMI owned by this account\n")
-		for k, v := range ssm {
-			fmt.Printf("ID: %s\tDesctiption: %s\n", k, v)
-		}
+	var findings []*finding
 
-		fmt.Printf("A total of %v snapshots found\n", len(ssm))
-	} else {
-		for k := range ssm {
-			fmt.Printf("%s\n", k)
+	err = svc.DescribeSnapshotsPages(&ec2.DescribeSnapshotsInput{OwnerIds: owners}, func(p *ec2.DescribeSnapshotsOutput, lastPage bool) bool {
+		for _, ss := range p.Snapshots {
+			if inImage[*ss.SnapshotId] {
+				continue
+			}
+			findings = append(findings, &finding{
+				Check:        s.ID(),
+				Severity:     severityLow,
+				ResourceType: "snapshot",
+				ResourceId:   *ss.SnapshotId,
+				Message:      "snapshot not associated with an AMI: " + safeString(ss.Description)})
 		}
-	}
-
-	return
+		return true
+	})
 
+	return findings, err
 }
 
 /*
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/mitchellh/cli"
+)
+
+type AStartCommand struct {
+	dryrun      bool
+	quiet       bool
+	verbose     bool
+	holidays    string
+	journal     string
+	asg         bool
+	elasticache bool
+	redshift    bool
+	Ui          cli.Ui
+}
+
+// Help function displays detailed help for ths autostart sub command
+func (c *AStartCommand) Help() string {
+	return `
+	Description:
+	Search the account for any stopped EC2 instances with an autostop tag
+	schedule that includes a start time and start the instance if the
+	schedule says it should now be running.
+	See awsgo-tools autostop --help for the schedule format.
+
+	Usage:
+		awsgo-tools autostart [flags]
+	
+	Flags:
+	-n - Dry Run to show which instances would be started but not make any changes
+	-q to suppress the no instances found message
+	-v - also show the instances that need no change and why
+	--holidays <file> - holiday calendar file. No instances are started on a holiday
+	--journal <file> - append every start to this journal file
+	--asg - also start tagged auto scale groups
+	--elasticache - also restore tagged ElastiCache redis clusters
+	--redshift - also restore tagged Redshift clusters
+	`
+}
+
+// Synopsis function returns a string with concise details of the sub command
+func (c *AStartCommand) Synopsis() string {
+	return "Auto start scheduled instances"
+}
+
+// Run function is the function called by the cli library to run the actual sub command code.
+func (c *AStartCommand) Run(args []string) int {
+
+	cmdFlags := flag.NewFlagSet("autostart", flag.ContinueOnError)
+	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+
+	cmdFlags.BoolVar(&c.dryrun, "n", false, "Dry Run")
+	cmdFlags.BoolVar(&c.quiet, "q", false, "Suppress no instances found message")
+	cmdFlags.BoolVar(&c.verbose, "v", false, "Produce verbose output")
+	cmdFlags.StringVar(&c.holidays, "holidays", "", "Holiday calendar file")
+	cmdFlags.StringVar(&c.journal, "journal", "", "Journal file to record changes in")
+	cmdFlags.BoolVar(&c.asg, "asg", false, "Autostop tagged auto scale groups")
+	cmdFlags.BoolVar(&c.elasticache, "elasticache", false, "Autostop tagged ElastiCache clusters")
+	cmdFlags.BoolVar(&c.redshift, "redshift", false, "Autostop tagged Redshift clusters")
+	if err := cmdFlags.Parse(args); err != nil {
+		return RCERR
+	}
+
+	holidays, err := loadHolidays(c.holidays)
+	if err != nil {
+		fmt.Printf("Fatal error: unable to load holiday calendar - %s\n", err)
+		return RCERR
+	}
+
+	// Create an EC2 service object
+	// config values keys, sercet key & region read from environment
+	svc := ec2.New(session.New(), &aws.Config{MaxRetries: aws.Int(10)})
+
+	decisions, err := scheduledInstances(svc, time.Now(), holidays)
+
+	if err != nil {
+		fmt.Printf("DescribeInstances fatal error: %s\n", err)
+		return RCERR
+	}
+
+	// autostart leaves stopping to autostop so only report on the start side
+	for _, d := range decisions {
+		if d.action == actionStop {
+			d.action = actionNone
+		}
+	}
+	logDecisions(decisions, c.verbose, true)
+
+	rc := startInstances(svc, decisionIds(decisions, actionStart), c.dryrun, c.quiet)
+	if rc == RCOK && !c.dryrun {
+		journalDecisions(c.journal, "autostart", svc, decisions, actionStart)
+	}
+
+	if c.asg || c.elasticache || c.redshift {
+		fleet, err := fleetDecisions(svc, c.asg, c.elasticache, c.redshift, time.Now(), holidays)
+		if err != nil {
+			fmt.Printf("Fatal error: %s\n", err)
+			return RCERR
+		}
+		for _, d := range fleet {
+			if d.action == actionStop {
+				d.action = actionNone
+				d.apply = nil
+			}
+		}
+		if applyFleet(fleet, true, c.dryrun, c.verbose, c.journal, "autostart", safeString(svc.Config.Region)) != RCOK {
+			rc = RCERR
+		}
+	}
+
+	return rc
+}
+
+/*
+
+ */
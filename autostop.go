@@ -3,17 +3,37 @@ package main
 import (
 	"flag"
 	"fmt"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/mitchellh/cli"
 )
 
 type ASCommand struct {
-	dryrun bool
-	quiet  bool
-	Ui     cli.Ui
+	dryrun      bool
+	quiet       bool
+	start       bool
+	verbose     bool
+	idle        bool
+	holidays    string
+	env         string
+	journal     string
+	asg         bool
+	elasticache bool
+	redshift    bool
+	limits      idleThresholds
+	warn        warnConfig
+	Ui          cli.Ui
+}
+
+// autoDecision records what autostop decided to do with an instance and why
+type autoDecision struct {
+	instance *ec2.Instance
+	action   string
+	reason   string
 }
 
 // Help function displays detailed help for ths autostop sub command
@@ -23,12 +43,65 @@ func (c *ASCommand) Help() string {
 	Search the account for any EC2 instances with a tag key of autostop
 	and in state running and stop the instance.
 
+	An empty tag value, or a value that is not a schedule such as true, stops the
+	instance every time autostop runs. The tag
+	value can also hold a schedule of the hours the instance should be running
+	such as stop=19:00;start=07:30;days=Mon-Fri;tz=Australia/Sydney
+	Instances outside their running hours are stopped. Instances inside their
+	running hours are started by autostart or by autostop with the -s flag.
+	days defaults to every day and tz defaults to the local timezone.
+	Instances in an auto scale group are skipped. Tag the group instead.
+
+	Auto scale groups, ElastiCache redis clusters and Redshift clusters with an
+	autostop tag follow the same schedules when selected with their flag. Groups
+	are scaled to zero with their min,desired,max sizes saved in an
+	autostop-capacity tag. Clusters are snapshotted to autostop-<cluster id> and
+	removed, then restored from that snapshot. A cluster is only removed once its
+	snapshot is newer than the cluster and the snapshot is removed once the
+	cluster is back. Each run moves a cluster one step so run autostop often.
+
+	An instance with a tag of autostop-skip-until=2026-10-20T09:00 is left
+	alone until that time in the timezone of its schedule.
+
+	With --warn a warning is sent the given number of minutes before an
+	instance is stopped, to an SNS topic, by SES email to the address in the
+	owner tag of each instance or as json to a webhook. At least one destination
+	is needed. Once a warning reaches a destination the instance is tagged with
+	autostop-warned and a later run stops it after the warning period has
+	passed. An instance whose warning was not delivered is not stopped. Adding an autostop-skip-until tag in the meantime defers the stop.
+	Run autostop at least every few minutes when using warnings.
+	Warnings cover instances only.
+
+	Every date in the holiday file is a stop day. The file can be an iCal file
+	or a list of dates in 2006-01-02 format, one per line.
+
+	In idle mode schedules are ignored. Running instances with a tag of
+	autostop=idle, or with an Environment tag matching --env, are stopped
+	if every hour of CloudWatch metrics for the last --idle-hours hours
+	is under both the CPU and network thresholds.
+
 	Usage:
 		awsgo-tools autostop [flags]
 	
 	Flags:
 	-n - Dry Run to show which instances would be stopped but not make any changes
 	-q to suppress the no instances found message
+	-s - also start instances whose schedule says they should be running
+	-v - also show the instances that need no change and why
+	--holidays <file> - holiday calendar file
+	--journal <file> - append every stop and start to this journal file
+	--asg - also autostop tagged auto scale groups
+	--elasticache - also autostop tagged ElastiCache redis clusters
+	--redshift - also autostop tagged Redshift clusters
+	--warn <minutes> - warn this many minutes before stopping an instance
+	--sns-topic <arn> - send warnings to this SNS topic
+	--ses-from <address> - email warnings to the owner tag address from this address
+	--webhook <url> - post warnings to this url
+	--idle - stop idle instances instead of using schedules
+	--env <name> - in idle mode check instances with this Environment tag value
+	--idle-hours <hours> - hours an instance must be idle before stopping. default 6
+	--cpu <percent> - hourly average CPU an idle instance must be under. default 5
+	--net <MB> - hourly network in plus out an idle instance must be under. default 5
 	`
 }
 
@@ -45,45 +118,288 @@ func (c *ASCommand) Run(args []string) int {
 
 	cmdFlags.BoolVar(&c.dryrun, "n", false, "Dry Run")
 	cmdFlags.BoolVar(&c.quiet, "q", false, "Suppress no instances found message")
+	cmdFlags.BoolVar(&c.start, "s", false, "Also start scheduled instances")
+	cmdFlags.BoolVar(&c.verbose, "v", false, "Produce verbose output")
+	cmdFlags.StringVar(&c.holidays, "holidays", "", "Holiday calendar file")
+	cmdFlags.StringVar(&c.journal, "journal", "", "Journal file to record changes in")
+	cmdFlags.BoolVar(&c.asg, "asg", false, "Autostop tagged auto scale groups")
+	cmdFlags.BoolVar(&c.elasticache, "elasticache", false, "Autostop tagged ElastiCache clusters")
+	cmdFlags.BoolVar(&c.redshift, "redshift", false, "Autostop tagged Redshift clusters")
+	cmdFlags.IntVar(&c.warn.minutes, "warn", 0, "Minutes to warn before stopping")
+	cmdFlags.StringVar(&c.warn.snsTopic, "sns-topic", "", "SNS topic for warnings")
+	cmdFlags.StringVar(&c.warn.sesFrom, "ses-from", "", "From address for warning emails")
+	cmdFlags.StringVar(&c.warn.webhook, "webhook", "", "Webhook url for warnings")
+	cmdFlags.BoolVar(&c.idle, "idle", false, "Stop idle instances")
+	cmdFlags.StringVar(&c.env, "env", "", "Environment tag value of idle mode instances")
+	cmdFlags.IntVar(&c.limits.hours, "idle-hours", 6, "Hours an instance must be idle")
+	cmdFlags.Float64Var(&c.limits.cpu, "cpu", 5, "Idle hourly average CPU percent")
+	cmdFlags.Float64Var(&c.limits.netMB, "net", 5, "Idle hourly network MB")
 	if err := cmdFlags.Parse(args); err != nil {
 		return RCERR
 	}
 
-	instanceSlice := []*string{}
+	if c.warn.minutes > 0 && len(c.warn.snsTopic) == 0 && len(c.warn.sesFrom) == 0 && len(c.warn.webhook) == 0 {
+		fmt.Printf("--warn needs somewhere to send warnings. Please provide --sns-topic, --ses-from or --webhook\n")
+		return RCERR
+	}
+
+	holidays, err := loadHolidays(c.holidays)
+	if err != nil {
+		fmt.Printf("Fatal error: unable to load holiday calendar - %s\n", err)
+		return RCERR
+	}
 
 	// Create an EC2 service object
 	// config values keys, sercet key & region read from environment
 	svc := ec2.New(session.New(), &aws.Config{MaxRetries: aws.Int(10)})
 
-	resp, err := svc.DescribeInstances(nil)
+	now := time.Now()
+	var decisions []*autoDecision
 
-	if err != nil {
-		fmt.Printf("DescribeInstances fatal error: %s\n", err)
-		return RCERR
+	if c.idle {
+		if c.limits.hours < 1 {
+			fmt.Printf("Number of idle hours must be greater than zero\n")
+			return RCERR
+		}
+
+		// Create a CloudWatch service object
+		// config values keys, sercet key & region read from environment
+		cwsvc := cloudwatch.New(session.New(), &aws.Config{MaxRetries: aws.Int(10)})
+
+		decisions, err = idleInstances(svc, cwsvc, now, c.env, c.limits)
+		if err != nil {
+			fmt.Printf("Idle check fatal error: %s\n", err)
+			return RCERR
+		}
+		// idle mode never starts instances and only looks at instances
+		c.start = false
+		c.asg, c.elasticache, c.redshift = false, false, false
+	} else {
+		decisions, err = scheduledInstances(svc, now, holidays)
+		if err != nil {
+			fmt.Printf("DescribeInstances fatal error: %s\n", err)
+			return RCERR
+		}
+	}
+
+	var cleared []*string
+	if c.warn.minutes > 0 {
+		var warn []*autoDecision
+		warn, cleared = warnDecisions(decisions, now, holidays, c.warn.minutes, !c.idle)
+		if err := sendWarnings(svc, warn, c.warn, now, c.dryrun, c.verbose); err != nil {
+			fmt.Printf("Warning - unable to send some stop warnings, stops are held until a warning is sent: %s\n", err)
+		}
+	}
+
+	logDecisions(decisions, c.verbose, c.start)
+
+	rc := stopInstances(svc, decisionIds(decisions, actionStop), c.dryrun, c.quiet)
+	if rc == RCOK && !c.dryrun {
+		journalDecisions(c.journal, "autostop", svc, decisions, actionStop)
+		clearWarnings(svc, cleared, c.dryrun)
+	}
+
+	if c.start {
+		if startInstances(svc, decisionIds(decisions, actionStart), c.dryrun, c.quiet) != RCOK {
+			rc = RCERR
+		} else if !c.dryrun {
+			journalDecisions(c.journal, "autostop", svc, decisions, actionStart)
+		}
 	}
 
-	// extract the instanceId with autostop tags and state running
-	for reservation := range resp.Reservations {
-		for instance := range resp.Reservations[reservation].Instances {
-			for tag := range resp.Reservations[reservation].Instances[instance].Tags {
-				if *resp.Reservations[reservation].Instances[instance].Tags[tag].Key == "autostop" &&
-					*resp.Reservations[reservation].Instances[instance].State.Name == "running" {
-					// Found an instance that needs stopping
-					instanceSlice = append(instanceSlice, resp.Reservations[reservation].Instances[instance].InstanceId)
-				}
+	if c.asg || c.elasticache || c.redshift {
+		fleet, err := fleetDecisions(svc, c.asg, c.elasticache, c.redshift, now, holidays)
+		if err != nil {
+			fmt.Printf("Fatal error: %s\n", err)
+			return RCERR
+		}
+		if applyFleet(fleet, c.start, c.dryrun, c.verbose, c.journal, "autostop", safeString(svc.Config.Region)) != RCOK {
+			rc = RCERR
+		}
+	}
+
+	return rc
+}
+
+// scheduledInstances decides what needs to happen to each instance with an autostop tag
+// at the time provided and returns the decisions
+func scheduledInstances(svc *ec2.EC2, now time.Time, holidays holidayCalendar) (decisions []*autoDecision, err error) {
+
+	ec2dii := ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			&ec2.Filter{
+				Name:   aws.String("tag-key"),
+				Values: []*string{aws.String("autostop")}}}}
+
+	err = svc.DescribeInstancesPages(&ec2dii, func(p *ec2.DescribeInstancesOutput, lastPage bool) bool {
+		for _, reservation := range p.Reservations {
+			for _, instance := range reservation.Instances {
+				decisions = append(decisions, decideInstance(instance, now, holidays))
 			}
 		}
+		return true
+	})
+
+	return decisions, err
+}
+
+// decideInstance applies the autostop schedule and any override tag of one instance
+func decideInstance(instance *ec2.Instance, now time.Time, holidays holidayCalendar) *autoDecision {
+
+	d := &autoDecision{instance: instance}
+
+	if skip, reason := asgMember(instance); skip {
+		d.action, d.reason = actionSkip, reason
+		return d
+	}
+
+	d.action, d.reason = decideTags(tagMap(instance.Tags), *instance.State.Name, now, holidays)
+	return d
+}
+
+// asgMember reports if an instance belongs to an auto scale group. A stopped instance in a
+// group is just replaced so the group is stopped instead
+func asgMember(instance *ec2.Instance) (bool, string) {
+	if asg := tagValue(instance.Tags, "aws:autoscaling:groupName"); len(asg) > 0 {
+		return true, "instance belongs to auto scale group " + asg + ". Tag the group to autostop it"
+	}
+	return false, ""
+}
+
+// decideTags applies the autostop schedule and any override tag found in the tags of a resource
+// that is currently in the state provided
+func decideTags(tags map[string]string, state string, now time.Time, holidays holidayCalendar) (action string, reason string) {
+
+	value := tags["autostop"]
+
+	// idle instances are only looked at when autostop runs in idle mode
+	if value == "idle" {
+		return actionNone, "autostop=idle instances are only stopped in idle mode"
+	}
+
+	schedule, err := parseSchedule(value)
+	if err != nil {
+		return actionSkip, fmt.Sprintf("invalid autostop schedule: %s", err)
+	}
+
+	if skip, reason := skipOverride(tags, now, schedule.loc); skip {
+		return actionSkip, reason
+	}
+
+	return schedule.decide(state, now, holidays)
+}
+
+// skipOverride checks for an autostop-skip-until tag and reports if the resource
+// should be left alone at the time provided
+func skipOverride(tags map[string]string, now time.Time, loc *time.Location) (skip bool, reason string) {
+
+	skipUntil := tags["autostop-skip-until"]
+	if len(skipUntil) == 0 {
+		return false, ""
+	}
+
+	until, err := parseSkipUntil(skipUntil, loc)
+	if err != nil {
+		return true, fmt.Sprintf("invalid autostop-skip-until value %q", skipUntil)
+	}
+	if now.Before(until) {
+		return true, "autostop-skip-until " + until.Format(time.RFC3339) + " not reached"
+	}
+	return false, ""
+}
+
+// parseSkipUntil converts the value of an autostop-skip-until tag to a time. Values without a
+// timezone are read in the timezone of the instance schedule
+func parseSkipUntil(value string, loc *time.Location) (time.Time, error) {
+
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	var err error
+	for _, layout := range []string{"2006-01-02T15:04", "2006-01-02T15:04:05", "2006-01-02"} {
+		var t time.Time
+		if t, err = time.ParseInLocation(layout, value, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+// logDecisions displays the reason for every stop, start or skip decision. Instances that
+// need no change are only shown in verbose mode
+func logDecisions(decisions []*autoDecision, verbose bool, start bool) {
+	for _, d := range decisions {
+		switch {
+		case d.action == actionStart && !start:
+			continue
+		case d.action == actionNone && !verbose:
+			continue
+		}
+		fmt.Printf("Info - Instance %s action: %s reason: %s\n", *d.instance.InstanceId, d.action, d.reason)
 	}
+}
+
+// journalDecisions records the decisions with the action provided in the journal file
+// so the savings report can work out how long each instance was stopped
+func journalDecisions(filename string, command string, svc *ec2.EC2, decisions []*autoDecision, action string) {
+
+	var entries []*journalEntry
+
+	for _, d := range decisions {
+		if d.action != action {
+			continue
+		}
+		entries = append(entries, &journalEntry{
+			Time:         time.Now().UTC(),
+			Command:      command,
+			Action:       action,
+			ResourceType: "instance",
+			ResourceId:   *d.instance.InstanceId,
+			Region:       safeString(svc.Config.Region),
+			Reason:       d.reason,
+			Details:      instanceDetails(d.instance),
+			Tags:         tagMap(d.instance.Tags),
+		})
+	}
+
+	if err := writeJournal(filename, entries); err != nil {
+		fmt.Printf("Warning - unable to write to journal %s: %s\n", filename, err)
+	}
+}
+
+// instanceDetails returns the instance type and last launch time for the journal. The launch
+// time lets the savings report work out when an instance was started by hand
+func instanceDetails(instance *ec2.Instance) map[string]string {
+	details := map[string]string{"instance_type": safeString(instance.InstanceType)}
+	if instance.LaunchTime != nil {
+		details["launch_time"] = instance.LaunchTime.UTC().Format(time.RFC3339)
+	}
+	return details
+}
+
+// decisionIds returns the instanceIds of the decisions with the action provided
+func decisionIds(decisions []*autoDecision, action string) (instanceSlice []*string) {
+	for _, d := range decisions {
+		if d.action == action {
+			instanceSlice = append(instanceSlice, d.instance.InstanceId)
+		}
+	}
+	return instanceSlice
+}
+
+// stopInstances stops the instances provided and displays the state changes
+func stopInstances(svc *ec2.EC2, instanceSlice []*string, dryrun bool, quiet bool) int {
 
 	// make sure we don't stop everything on the account
 	if len(instanceSlice) < 1 {
-		if !c.quiet {
+		if !quiet {
 			fmt.Printf("No autostop instances found\n")
 		}
 		return RCOK
 	}
 
-	if c.dryrun == true {
+	if dryrun == true {
 		for _, i := range instanceSlice {
 			fmt.Printf("Dry Run - Would have stopped instance %s\n", *i)
 		}
@@ -99,11 +415,46 @@ func (c *ASCommand) Run(args []string) int {
 		return RCERR
 	}
 
-	for statechange := range stopinstanceResp.StoppingInstances {
-		fmt.Printf("InstanceId: %s\t\tPrevious state: %s\t\tNew State: %s\n",
-			*stopinstanceResp.StoppingInstances[statechange].InstanceId,
-			*stopinstanceResp.StoppingInstances[statechange].PreviousState.Name,
-			*stopinstanceResp.StoppingInstances[statechange].CurrentState.Name)
+	printStateChanges(stopinstanceResp.StoppingInstances)
+	return RCOK
+}
+
+// startInstances starts the instances provided and displays the state changes
+func startInstances(svc *ec2.EC2, instanceSlice []*string, dryrun bool, quiet bool) int {
+
+	if len(instanceSlice) < 1 {
+		if !quiet {
+			fmt.Printf("No autostart instances found\n")
+		}
+		return RCOK
 	}
+
+	if dryrun == true {
+		for _, i := range instanceSlice {
+			fmt.Printf("Dry Run - Would have started instance %s\n", *i)
+		}
+		return RCOK
+	}
+
+	ec2sii := ec2.StartInstancesInput{InstanceIds: instanceSlice}
+
+	startinstanceResp, err := svc.StartInstances(&ec2sii)
+
+	if err != nil {
+		fmt.Printf("StartInstances fatal error: %s\n", err)
+		return RCERR
+	}
+
+	printStateChanges(startinstanceResp.StartingInstances)
 	return RCOK
 }
+
+// printStateChanges displays the result of a stop or start request
+func printStateChanges(stateChanges []*ec2.InstanceStateChange) {
+	for _, statechange := range stateChanges {
+		fmt.Printf("InstanceId: %s\t\tPrevious state: %s\t\tNew State: %s\n",
+			*statechange.InstanceId,
+			*statechange.PreviousState.Name,
+			*statechange.CurrentState.Name)
+	}
+}
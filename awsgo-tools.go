@@ -33,6 +33,27 @@ func main() {
 				},
 			}, nil
 		},
+		"asg-report": func() (cli.Command, error) {
+			return &ASGReportCommand{
+				Ui: &cli.ColoredUi{
+					Ui: ui,
+				},
+			}, nil
+		},
+		"backup-report": func() (cli.Command, error) {
+			return &BackupReportCommand{
+				Ui: &cli.ColoredUi{
+					Ui: ui,
+				},
+			}, nil
+		},
+		"iam-hygiene": func() (cli.Command, error) {
+			return &IAMHygieneCommand{
+				Ui: &cli.ColoredUi{
+					Ui: ui,
+				},
+			}, nil
+		},
 		"iamssl": func() (cli.Command, error) {
 			return &IAMsslCommand{
 				Ui: &cli.ColoredUi{
@@ -47,6 +68,41 @@ func main() {
 				},
 			}, nil
 		},
+		"autostart": func() (cli.Command, error) {
+			return &AStartCommand{
+				Ui: &cli.ColoredUi{
+					Ui: ui,
+				},
+			}, nil
+		},
+		"verify-backups": func() (cli.Command, error) {
+			return &VerifyCommand{
+				Ui: &cli.ColoredUi{
+					Ui: ui,
+				},
+			}, nil
+		},
+		"restore": func() (cli.Command, error) {
+			return &RestoreCommand{
+				Ui: &cli.ColoredUi{
+					Ui: ui,
+				},
+			}, nil
+		},
+		"encrypt": func() (cli.Command, error) {
+			return &EncryptCommand{
+				Ui: &cli.ColoredUi{
+					Ui: ui,
+				},
+			}, nil
+		},
+		"undelete": func() (cli.Command, error) {
+			return &UndeleteCommand{
+				Ui: &cli.ColoredUi{
+					Ui: ui,
+				},
+			}, nil
+		},
 		"snapshot": func() (cli.Command, error) {
 			return &SSCommand{
 				Ui: &cli.ColoredUi{
@@ -61,6 +117,13 @@ func main() {
 				},
 			}, nil
 		},
+		"ami-share": func() (cli.Command, error) {
+			return &AMIShareCommand{
+				Ui: &cli.ColoredUi{
+					Ui: ui,
+				},
+			}, nil
+		},
 		"ami-cleanup": func() (cli.Command, error) {
 			return &AMICommand{
 				Ui: &cli.ColoredUi{
@@ -75,6 +138,13 @@ func main() {
 				},
 			}, nil
 		},
+		"savings": func() (cli.Command, error) {
+			return &SavingsCommand{
+				Ui: &cli.ColoredUi{
+					Ui: ui,
+				},
+			}, nil
+		},
 		"s3info": func() (cli.Command, error) {
 			return &S3infoCommand{
 				Ui: &cli.ColoredUi{
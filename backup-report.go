@@ -0,0 +1,308 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/mitchellh/cli"
+)
+
+type BackupReportCommand struct {
+	all    bool
+	csv    bool
+	maxAge int
+	stuck  int
+	Ui     cli.Ui
+}
+
+// backupItem is one AMI or volume snapshot made by the snapshot command
+type backupItem struct {
+	id         string
+	backupType string
+	state      string
+	created    time.Time
+	retention  string
+}
+
+// backupCoverage holds the backups of one instance and the coverage problems found
+type backupCoverage struct {
+	instanceId string
+	name       string
+	tagged     bool
+	newest     *backupItem
+	lastGood   *backupItem
+	problems   []string
+}
+
+// Help function displays detailed help for the backup-report sub command
+func (c *BackupReportCommand) Help() string {
+	return `
+	Description:
+	Report the newest backup of each instance tagged autobkup. The AMI's and volume
+	snapshots made by the snapshot command are matched to their source instance and
+	the last good backup, its age, state and retention policy are shown.
+
+	An instance is flagged if it has no good backup within --max-age hours, if its
+	newest backup failed or if it has an AMI or snapshot still pending after --stuck
+	hours. The command exits with an error if any instance tagged autobkup is flagged
+	so it can be run from cron or a monitoring check.
+
+	Usage:
+		awsgo-tools backup-report [flags]
+
+	Flags:
+	--all - report every instance. Instances not tagged autobkup are shown but
+		do not cause an error exit
+	--max-age <hours> - hours within which each instance needs a good backup. default 26
+	--stuck <hours> - hours after which a pending AMI or snapshot is stuck. default 3
+	-c - produce output in csv format
+	`
+}
+
+// Synopsis function returns a string with concise details of the sub command
+func (c *BackupReportCommand) Synopsis() string {
+	return "Backup coverage report"
+}
+
+// Run function is the function called by the cli library to run the actual sub command code.
+func (c *BackupReportCommand) Run(args []string) int {
+
+	cmdFlags := flag.NewFlagSet("backup-report", flag.ContinueOnError)
+	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+
+	cmdFlags.BoolVar(&c.all, "all", false, "Report every instance")
+	cmdFlags.IntVar(&c.maxAge, "max-age", 26, "Hours within which each instance needs a good backup")
+	cmdFlags.IntVar(&c.stuck, "stuck", 3, "Hours after which a pending backup is stuck")
+	cmdFlags.BoolVar(&c.csv, "c", false, "Produce output in csv format")
+	if err := cmdFlags.Parse(args); err != nil {
+		return RCERR
+	}
+
+	// Create an EC2 service object
+	// config values keys, sercet key & region read from environment
+	svc := ec2.New(session.New(), &aws.Config{MaxRetries: aws.Int(10)})
+
+	coverage, err := c.instanceCoverage(svc)
+	if err != nil {
+		fmt.Printf("DescribeInstances fatal error: %s\n", err)
+		return RCERR
+	}
+
+	backups, err := instanceBackups(svc)
+	if err != nil {
+		fmt.Printf("Fatal error: unable to read backups - %s\n", err)
+		return RCERR
+	}
+
+	now := time.Now()
+	violations := 0
+
+	for _, bc := range coverage {
+		bc.check(backups[bc.instanceId], now, time.Duration(c.maxAge)*time.Hour, time.Duration(c.stuck)*time.Hour)
+		if bc.tagged && len(bc.problems) > 0 {
+			violations++
+		}
+	}
+
+	if c.csv {
+		fmt.Printf("Instance Id, Name, Tagged, Last Good Backup, Type, Created, Age Hours, Retention, Newest State, Problems\n")
+	}
+	for _, bc := range coverage {
+		bc.print(now, c.csv)
+	}
+
+	if !c.csv {
+		fmt.Printf("\nBackup coverage - instances: %d ok: %d violations: %d\n", len(coverage), len(coverage)-violations, violations)
+	}
+
+	if violations > 0 {
+		return RCERR
+	}
+	return RCOK
+}
+
+// instanceCoverage returns the instances to report on sorted by instance id. Terminated instances
+// are ignored and only instances tagged autobkup are returned unless all was requested
+func (c *BackupReportCommand) instanceCoverage(svc *ec2.EC2) ([]*backupCoverage, error) {
+
+	ec2dii := ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			&ec2.Filter{
+				Name: aws.String("instance-state-name"),
+				Values: []*string{
+					aws.String(ec2.InstanceStateNamePending),
+					aws.String(ec2.InstanceStateNameRunning),
+					aws.String(ec2.InstanceStateNameStopping),
+					aws.String(ec2.InstanceStateNameStopped)}}}}
+
+	var coverage []*backupCoverage
+
+	err := svc.DescribeInstancesPages(&ec2dii, func(p *ec2.DescribeInstancesOutput, lastPage bool) bool {
+		for _, reservation := range p.Reservations {
+			for _, instance := range reservation.Instances {
+				_, tagged := tagMap(instance.Tags)["autobkup"]
+				if !tagged && !c.all {
+					continue
+				}
+				coverage = append(coverage, &backupCoverage{
+					instanceId: *instance.InstanceId,
+					name:       tagValue(instance.Tags, "Name"),
+					tagged:     tagged})
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(coverage, func(i, j int) bool { return coverage[i].instanceId < coverage[j].instanceId })
+	return coverage, nil
+}
+
+// instanceBackups returns the AMI's and volume snapshots made by the snapshot command keyed
+// by source instance. DR copies are left out as they are reported in their own region
+func instanceBackups(svc *ec2.EC2) (map[string][]*backupItem, error) {
+
+	backups := make(map[string][]*backupItem)
+
+	ec2dii := ec2.DescribeImagesInput{
+		Owners: []*string{aws.String("self")},
+		Filters: []*ec2.Filter{
+			&ec2.Filter{
+				Name:   aws.String("tag-key"),
+				Values: []*string{aws.String("autocleanup")}}}}
+
+	imagesResp, err := svc.DescribeImages(&ec2dii)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, image := range imagesResp.Images {
+		if len(tagValue(image.Tags, "autobkup-source-image")) > 0 {
+			continue
+		}
+		group := imageGroup(image)
+		backups[group] = append(backups[group], &backupItem{
+			id:         *image.ImageId,
+			backupType: "ami",
+			state:      safeString(image.State),
+			created:    imageCreated(image),
+			retention:  tagValue(image.Tags, "autobkup-retention")})
+	}
+
+	ec2dsi := ec2.DescribeSnapshotsInput{
+		OwnerIds: []*string{aws.String("self")},
+		Filters: []*ec2.Filter{
+			&ec2.Filter{
+				Name:   aws.String("tag-key"),
+				Values: []*string{aws.String("autobkup-source-volume")}}}}
+
+	err = svc.DescribeSnapshotsPages(&ec2dsi, func(p *ec2.DescribeSnapshotsOutput, lastPage bool) bool {
+		for _, snapshot := range p.Snapshots {
+			instanceId := tagValue(snapshot.Tags, "autobkup-source-instance")
+			if len(instanceId) == 0 {
+				continue
+			}
+
+			item := &backupItem{
+				id:         *snapshot.SnapshotId,
+				backupType: "snapshot",
+				state:      safeString(snapshot.State),
+				retention:  tagValue(snapshot.Tags, "autobkup-retention")}
+			if epoch, err := strconv.ParseInt(tagValue(snapshot.Tags, "autocleanup"), 10, 64); err == nil {
+				item.created = time.Unix(epoch, 0)
+			} else if snapshot.StartTime != nil {
+				item.created = *snapshot.StartTime
+			}
+			backups[instanceId] = append(backups[instanceId], item)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, items := range backups {
+		sort.SliceStable(items, func(i, j int) bool { return items[i].created.After(items[j].created) })
+	}
+	return backups, nil
+}
+
+// check finds the newest and last good backup of the instance from its backups, sorted newest
+// first, and records any coverage problems
+func (bc *backupCoverage) check(items []*backupItem, now time.Time, maxAge time.Duration, stuck time.Duration) {
+
+	if len(items) > 0 {
+		bc.newest = items[0]
+	}
+
+	for _, item := range items {
+		switch item.state {
+		case ec2.ImageStateAvailable, ec2.SnapshotStateCompleted:
+			if bc.lastGood == nil {
+				bc.lastGood = item
+			}
+		case ec2.ImageStatePending:
+			if now.Sub(item.created) > stuck {
+				bc.problems = append(bc.problems, fmt.Sprintf("%s %s pending for %.1f hours", item.backupType, item.id, now.Sub(item.created).Hours()))
+			}
+		}
+	}
+
+	switch {
+	case !bc.tagged:
+		bc.problems = append(bc.problems, "not tagged autobkup")
+	case bc.lastGood == nil:
+		bc.problems = append(bc.problems, "no good backup")
+	case now.Sub(bc.lastGood.created) > maxAge:
+		bc.problems = append(bc.problems, fmt.Sprintf("no good backup in %.0f hours", maxAge.Hours()))
+	}
+
+	if bc.newest != nil && bc.newest != bc.lastGood && bc.newest.state != ec2.ImageStatePending {
+		bc.problems = append(bc.problems, fmt.Sprintf("newest %s %s is %s", bc.newest.backupType, bc.newest.id, bc.newest.state))
+	}
+}
+
+// print displays the coverage line of the instance
+func (bc *backupCoverage) print(now time.Time, csv bool) {
+
+	var backupId, backupType, created, age, retention, newestState string
+	if bc.lastGood != nil {
+		backupId = bc.lastGood.id
+		backupType = bc.lastGood.backupType
+		created = bc.lastGood.created.UTC().Format(time.RFC3339)
+		age = fmt.Sprintf("%.1f", now.Sub(bc.lastGood.created).Hours())
+		retention = bc.lastGood.retention
+	}
+	if bc.newest != nil {
+		newestState = bc.newest.state
+	}
+
+	if csv {
+		fmt.Printf("%s,%s,%t,%s,%s,%s,%s,%s,%s,%s\n", bc.instanceId, bc.name, bc.tagged, backupId, backupType,
+			created, age, retention, newestState, strings.Join(bc.problems, "; "))
+		return
+	}
+
+	status := "OK"
+	if len(bc.problems) > 0 {
+		status = "FLAGGED"
+	}
+	if bc.lastGood == nil {
+		fmt.Printf("%s\t%s\t%s\tno good backup\n", status, bc.instanceId, bc.name)
+	} else {
+		fmt.Printf("%s\t%s\t%s\t%s %s\t%s hours old\tretention: %s\n", status, bc.instanceId, bc.name,
+			backupType, backupId, age, retention)
+	}
+	for _, problem := range bc.problems {
+		fmt.Printf("\t- %s\n", problem)
+	}
+}
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/mitchellh/cli"
+)
+
+// encryptedFromTag records the unencrypted AMI or snapshot an encrypted copy was made from
+const encryptedFromTag = "encrypted-from"
+
+type EncryptCommand struct {
+	verbose  bool
+	dryrun   bool
+	automode bool
+	retire   bool
+	grace    int
+	timeout  int
+	id       string
+	kmsKey   string
+	Ui       cli.Ui
+}
+
+// encryptJob tracks the encrypted copy of one AMI or volume snapshot
+type encryptJob struct {
+	image    *ec2.Image
+	snapshot *ec2.Snapshot
+	newId    string
+	existing bool // the encrypted copy was made by an earlier run
+	err      error
+}
+
+// encryptedCopy is an encrypted copy made by an earlier run and whether it is ready to use
+type encryptedCopy struct {
+	id    string
+	ready bool
+}
+
+// Help function displays detailed help for the encrypt sub command
+func (c *EncryptCommand) Help() string {
+	return `
+	Description:
+	Make encrypted copies of unencrypted EBS snapshots and AMI's owned by the account.
+	AMI's are copied with encryption so the copy keeps the attributes of the
+	original. Volume snapshots are copied with encryption. All tags are carried
+	over and the copy is tagged encrypted-from with the original id. AMI's and
+	snapshots that already have an encrypted copy are skipped so it is safe to
+	run again.
+
+	Usage:
+		awsgo-tools encrypt [flags]
+
+	Flags:
+	-a - encrypt every unencrypted AMI and volume snapshot in the account
+	-i <id> - AMI or snapshot id to encrypt
+	--kms-key <key> - KMS key id or arn to encrypt with. default the EBS default key
+	--retire - delete the originals once their encrypted copy is ready, including
+		originals encrypted by an earlier run. AMI's are deleted by the ami-cleanup
+		path without needing an autocleanup tag. AMI's in use are kept
+	--grace <days> - with --retire mark the originals pending-delete as
+		ami-cleanup --grace does rather than deleting them
+	-t <minutes> - time to wait for the copies of each AMI or snapshot. default 60
+	-n - Dry run. Report what would have happened but make no changes
+	-v - Produce verbose output
+	`
+}
+
+// Synopsis function returns a string with concise details of the sub command
+func (c *EncryptCommand) Synopsis() string {
+	return "Encrypt unencrypted AMI's & snapshots"
+}
+
+// Run function is the function called by the cli library to run the actual sub command code.
+func (c *EncryptCommand) Run(args []string) int {
+
+	cmdFlags := flag.NewFlagSet("encrypt", flag.ContinueOnError)
+	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+
+	cmdFlags.BoolVar(&c.verbose, "v", false, "Produce verbose output")
+	cmdFlags.BoolVar(&c.dryrun, "n", false, "Dry Run")
+	cmdFlags.BoolVar(&c.automode, "a", false, "Encrypt every unencrypted AMI and snapshot")
+	cmdFlags.StringVar(&c.id, "i", "", "AMI or snapshot to encrypt")
+	cmdFlags.StringVar(&c.kmsKey, "kms-key", "", "KMS key to encrypt with")
+	cmdFlags.BoolVar(&c.retire, "retire", false, "Delete the originals once encrypted")
+	cmdFlags.IntVar(&c.grace, "grace", 0, "Days originals stay pending-delete when retired")
+	cmdFlags.IntVar(&c.timeout, "t", 60, "Minutes to wait for the copies of each AMI or snapshot")
+	if err := cmdFlags.Parse(args); err != nil {
+		return RCERR
+	}
+
+	// make sure we are in auto mode or an id has been provided
+	if !c.automode && len(c.id) == 0 {
+		fmt.Printf("No AMI or snapshot provided. Please provide an id to encrypt\nor use -a to encrypt everything unencrypted.\n")
+		return RCERR
+	}
+
+	// Create an EC2 service object
+	// config values keys, sercet key & region read from environment
+	svc := ec2.New(session.New(), &aws.Config{MaxRetries: aws.Int(10)})
+
+	jobs, err := c.encryptJobs(svc)
+	if err != nil {
+		fmt.Printf("Fatal error: %s\n", err)
+		return RCERR
+	}
+
+	if len(jobs) == 0 {
+		if c.verbose {
+			fmt.Printf("No unencrypted AMI's or snapshots found\n")
+		}
+		return RCOK
+	}
+
+	rc := RCOK
+	for _, job := range jobs {
+		if job.existing {
+			if !c.dryrun && c.retireOriginal(svc, job) != RCOK {
+				rc = RCERR
+			}
+			continue
+		}
+		if job.image != nil {
+			c.encryptImage(svc, job)
+		} else {
+			c.encryptSnapshot(svc, job)
+		}
+
+		switch {
+		case job.err != nil:
+			fmt.Printf("Failed %s: %s\n", job.sourceId(), job.err)
+			rc = RCERR
+		case c.dryrun:
+		default:
+			fmt.Printf("Encrypted %s as %s\n", job.sourceId(), job.newId)
+			if c.retire && c.retireOriginal(svc, job) != RCOK {
+				rc = RCERR
+			}
+		}
+	}
+	return rc
+}
+
+// sourceId returns the id of the AMI or snapshot being encrypted
+func (job *encryptJob) sourceId() string {
+	if job.image != nil {
+		return *job.image.ImageId
+	}
+	return *job.snapshot.SnapshotId
+}
+
+// encryptJobs returns the AMI's with an unencrypted snapshot and the unencrypted snapshots that
+// do not belong to an AMI. Snapshots of AMI's are encrypted with their AMI
+func (c *EncryptCommand) encryptJobs(svc *ec2.EC2) ([]*encryptJob, error) {
+
+	var jobs []*encryptJob
+
+	copies, err := encryptedCopies(svc)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.automode || strings.HasPrefix(c.id, "ami-") {
+
+		ec2dii := ec2.DescribeImagesInput{Owners: []*string{aws.String("self")}}
+		if !c.automode {
+			ec2dii = ec2.DescribeImagesInput{ImageIds: []*string{aws.String(c.id)}}
+		}
+
+		imagesResp, err := svc.DescribeImages(&ec2dii)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, image := range imagesResp.Images {
+			if safeString(image.State) != ec2.ImageStateAvailable || safeString(image.RootDeviceType) != ec2.DeviceTypeEbs {
+				if !c.automode {
+					fmt.Printf("AMI %s is not an available EBS AMI and cannot be encrypted\n", *image.ImageId)
+				}
+				continue
+			}
+			if copies[*image.ImageId] != nil {
+				if job := c.existingCopy(image.ImageId, copies); job != nil {
+					job.image = image
+					jobs = append(jobs, job)
+				}
+				continue
+			}
+			if len(unencryptedSnapshots(svc, image)) == 0 {
+				if !c.automode {
+					fmt.Printf("AMI %s is already encrypted\n", *image.ImageId)
+				}
+				continue
+			}
+			jobs = append(jobs, &encryptJob{image: image})
+		}
+	}
+
+	if c.automode || strings.HasPrefix(c.id, "snap-") {
+
+		ec2dsi := ec2.DescribeSnapshotsInput{
+			OwnerIds: []*string{aws.String("self")},
+			Filters: []*ec2.Filter{
+				&ec2.Filter{
+					Name:   aws.String("encrypted"),
+					Values: []*string{aws.String("false")}},
+				&ec2.Filter{
+					Name:   aws.String("status"),
+					Values: []*string{aws.String(ec2.SnapshotStateCompleted)}}}}
+		if !c.automode {
+			ec2dsi = ec2.DescribeSnapshotsInput{SnapshotIds: []*string{aws.String(c.id)}}
+		}
+
+		// snapshots of an AMI can not be replaced on their own
+		imageSnapshotIds := make(map[string]string)
+		imagesResp, err := svc.DescribeImages(&ec2.DescribeImagesInput{Owners: []*string{aws.String("self")}})
+		if err != nil {
+			return nil, err
+		}
+		for _, image := range imagesResp.Images {
+			for _, snapshotId := range imageSnapshots(image) {
+				imageSnapshotIds[snapshotId] = *image.ImageId
+			}
+		}
+
+		err = svc.DescribeSnapshotsPages(&ec2dsi, func(p *ec2.DescribeSnapshotsOutput, lastPage bool) bool {
+			for _, snapshot := range p.Snapshots {
+				switch {
+				case aws.BoolValue(snapshot.Encrypted):
+					if !c.automode {
+						fmt.Printf("Snapshot %s is already encrypted\n", *snapshot.SnapshotId)
+					}
+				case copies[*snapshot.SnapshotId] != nil:
+					if job := c.existingCopy(snapshot.SnapshotId, copies); job != nil {
+						job.snapshot = snapshot
+						jobs = append(jobs, job)
+					}
+				case len(imageSnapshotIds[*snapshot.SnapshotId]) > 0:
+					if !c.automode {
+						fmt.Printf("Snapshot %s belongs to AMI %s. Encrypt the AMI instead\n", *snapshot.SnapshotId, imageSnapshotIds[*snapshot.SnapshotId])
+					}
+				default:
+					jobs = append(jobs, &encryptJob{snapshot: snapshot})
+				}
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return jobs, nil
+}
+
+// existingCopy reports an AMI or snapshot that already has an encrypted copy so it is not copied
+// again. With --retire it returns a job to retire the original once the copy is ready
+func (c *EncryptCommand) existingCopy(sourceId *string, copies map[string]*encryptedCopy) *encryptJob {
+
+	copied := copies[*sourceId]
+	if c.retire && copied.ready {
+		if c.dryrun || c.verbose {
+			fmt.Printf("Info - %s already has encrypted copy %s and will be retired\n", *sourceId, copied.id)
+		}
+		return &encryptJob{newId: copied.id, existing: true}
+	}
+	if !c.automode || c.verbose {
+		fmt.Printf("%s already has encrypted copy %s\n", *sourceId, copied.id)
+	}
+	return nil
+}
+
+// encryptedCopies returns the encrypted copy of each AMI or snapshot that has one, keyed by the
+// id in its encrypted-from tag. Failed copies do not count so they are tried again
+func encryptedCopies(svc *ec2.EC2) (map[string]*encryptedCopy, error) {
+
+	copies := make(map[string]*encryptedCopy)
+	tagged := []*ec2.Filter{
+		&ec2.Filter{
+			Name:   aws.String("tag-key"),
+			Values: []*string{aws.String(encryptedFromTag)}}}
+
+	imagesResp, err := svc.DescribeImages(&ec2.DescribeImagesInput{Owners: []*string{aws.String("self")}, Filters: tagged})
+	if err != nil {
+		return nil, err
+	}
+	for _, image := range imagesResp.Images {
+		if safeString(image.State) != ec2.ImageStateFailed {
+			copies[tagValue(image.Tags, encryptedFromTag)] = &encryptedCopy{
+				id:    *image.ImageId,
+				ready: safeString(image.State) == ec2.ImageStateAvailable}
+		}
+	}
+
+	ec2dsi := ec2.DescribeSnapshotsInput{OwnerIds: []*string{aws.String("self")}, Filters: tagged}
+	err = svc.DescribeSnapshotsPages(&ec2dsi, func(p *ec2.DescribeSnapshotsOutput, lastPage bool) bool {
+		for _, snapshot := range p.Snapshots {
+			source := tagValue(snapshot.Tags, encryptedFromTag)
+			if safeString(snapshot.State) != ec2.SnapshotStateError && copies[source] == nil {
+				copies[source] = &encryptedCopy{
+					id:    *snapshot.SnapshotId,
+					ready: safeString(snapshot.State) == ec2.SnapshotStateCompleted}
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return copies, nil
+}
+
+// unencryptedSnapshots returns the snapshots of an AMI that are not encrypted
+func unencryptedSnapshots(svc *ec2.EC2, image *ec2.Image) []*ec2.Snapshot {
+
+	var ids []*string
+	for _, snapshotId := range imageSnapshots(image) {
+		ids = append(ids, aws.String(snapshotId))
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	resp, err := svc.DescribeSnapshots(&ec2.DescribeSnapshotsInput{SnapshotIds: ids})
+	if err != nil {
+		fmt.Printf("Warning - unable to describe snapshots of AMI %s: %s\n", *image.ImageId, err)
+		return nil
+	}
+
+	var unencrypted []*ec2.Snapshot
+	for _, snapshot := range resp.Snapshots {
+		if !aws.BoolValue(snapshot.Encrypted) {
+			unencrypted = append(unencrypted, snapshot)
+		}
+	}
+	return unencrypted
+}
+
+// encryptImage copies an AMI with encryption, which keeps its attributes such as product codes,
+// platform and ENA support, and carries its tags over to the copy and its snapshots
+func (c *EncryptCommand) encryptImage(svc *ec2.EC2, job *encryptJob) {
+
+	image := job.image
+
+	if c.dryrun {
+		fmt.Printf("Dry Run - Would have made an encrypted copy of AMI %s\n", *image.ImageId)
+		return
+	}
+
+	// AMI names are limited to 128 characters
+	name := safeString(image.Name)
+	if len(name) > 118 {
+		name = name[:118]
+	}
+	name += " encrypted"
+
+	ec2cii := ec2.CopyImageInput{
+		SourceImageId: image.ImageId,
+		SourceRegion:  svc.Config.Region,
+		Name:          aws.String(name),
+		Description:   image.Description,
+		Encrypted:     aws.Bool(true)}
+	if len(c.kmsKey) > 0 {
+		ec2cii.KmsKeyId = aws.String(c.kmsKey)
+	}
+
+	copyResp, err := svc.CopyImage(&ec2cii)
+	if err != nil {
+		job.err = fmt.Errorf("copying AMI: %s", err)
+		return
+	}
+
+	copied := &createdImage{
+		imageId: *copyResp.ImageId,
+		name:    name,
+		state:   ec2.ImageStatePending,
+		tags:    carriedTags(image.Tags, *image.ImageId)}
+
+	// tag the copy straight away so a later run knows this AMI has been encrypted
+	if err := tagImage(svc, copied.imageId, copied.tags); err != nil {
+		fmt.Printf("Warning - problem adding tags to AMI: %s. Error was %s\n", copied.imageId, err)
+	} else if c.verbose {
+		fmt.Printf("Info - Started encrypted copy: %s of AMI: %s\n", copied.imageId, *image.ImageId)
+	}
+
+	if c.verbose {
+		fmt.Printf("Info - Waiting up to %d minutes for the encrypted copy of AMI %s...\n", c.timeout, *image.ImageId)
+	}
+	waitForImages(svc, []*createdImage{copied}, time.Duration(c.timeout)*time.Minute)
+
+	if copied.state != ec2.ImageStateAvailable {
+		job.err = fmt.Errorf("encrypted AMI %s is %s", copied.imageId, copied.state)
+		return
+	}
+	tagImageSnapshots(svc, []*createdImage{copied}, c.verbose)
+	job.newId = copied.imageId
+}
+
+// encryptSnapshot copies a volume snapshot with encryption and waits for the copy to complete
+func (c *EncryptCommand) encryptSnapshot(svc *ec2.EC2, job *encryptJob) {
+
+	snapshot := job.snapshot
+
+	if c.dryrun {
+		fmt.Printf("Dry Run - Would have made an encrypted copy of snapshot %s\n", *snapshot.SnapshotId)
+		return
+	}
+
+	copied, err := c.copySnapshot(svc, snapshot)
+	if err != nil {
+		job.err = err
+		return
+	}
+
+	if c.verbose {
+		fmt.Printf("Info - Waiting up to %d minutes for the encrypted copy of snapshot %s...\n", c.timeout, *snapshot.SnapshotId)
+	}
+	waitForSnapshots(svc, []*createdSnapshot{copied}, time.Duration(c.timeout)*time.Minute)
+
+	if copied.state != ec2.SnapshotStateCompleted {
+		job.err = fmt.Errorf("encrypted snapshot %s is %s", copied.snapshotId, copied.state)
+		return
+	}
+	job.newId = copied.snapshotId
+}
+
+// copySnapshot starts an encrypted copy of a snapshot in the same region and tags the copy
+// with the tags of the original
+func (c *EncryptCommand) copySnapshot(svc *ec2.EC2, snapshot *ec2.Snapshot) (*createdSnapshot, error) {
+
+	ec2csi := ec2.CopySnapshotInput{
+		SourceRegion:     svc.Config.Region,
+		SourceSnapshotId: snapshot.SnapshotId,
+		Description:      aws.String(safeString(snapshot.Description) + " encrypted"),
+		Encrypted:        aws.Bool(true)}
+	if len(c.kmsKey) > 0 {
+		ec2csi.KmsKeyId = aws.String(c.kmsKey)
+	}
+
+	copyResp, err := svc.CopySnapshot(&ec2csi)
+	if err != nil {
+		return nil, err
+	}
+
+	copied := &createdSnapshot{
+		snapshotId: *copyResp.SnapshotId,
+		volumeId:   safeString(snapshot.VolumeId),
+		state:      ec2.SnapshotStatePending}
+
+	ec2cti := ec2.CreateTagsInput{
+		Resources: []*string{copyResp.SnapshotId},
+		Tags:      carriedTags(snapshot.Tags, *snapshot.SnapshotId)}
+
+	if _, err := svc.CreateTags(&ec2cti); err != nil {
+		fmt.Printf("Warning - problem adding tags to snapshot: %s. Error was %s\n", copied.snapshotId, err)
+	} else if c.verbose {
+		fmt.Printf("Info - Started encrypted copy: %s of snapshot: %s\n", copied.snapshotId, *snapshot.SnapshotId)
+	}
+	return copied, nil
+}
+
+// carriedTags returns the tags to put on an encrypted copy. The aws: tags are reserved and the
+// pending-delete and autocleanup-exempt tags belong to the original
+func carriedTags(tags []*ec2.Tag, sourceId string) []*ec2.Tag {
+
+	var carried []*ec2.Tag
+	for _, tag := range tags {
+		key := safeString(tag.Key)
+		if strings.HasPrefix(key, "aws:") || key == pendingDeleteTag || key == pendingPermissionsTag || key == exemptTag || key == encryptedFromTag {
+			continue
+		}
+		carried = append(carried, &ec2.Tag{Key: tag.Key, Value: tag.Value})
+	}
+	return append(carried, &ec2.Tag{Key: aws.String(encryptedFromTag), Value: aws.String(sourceId)})
+}
+
+// retireOriginal removes the original once its encrypted copy is ready. AMI's go through the
+// ami-cleanup path so in use AMI's are kept and --grace marks them pending-delete
+func (c *EncryptCommand) retireOriginal(svc *ec2.EC2, job *encryptJob) int {
+
+	if job.snapshot != nil {
+		if since := tagValue(job.snapshot.Tags, exemptTag); len(since) > 0 {
+			fmt.Printf("Not retiring snapshot %s. Exempted by undelete at %s\n", *job.snapshot.SnapshotId, since)
+			return RCOK
+		}
+		// with a grace period the snapshot is marked now and deleted by a later run
+		cleanup := &AMICommand{verbose: c.verbose, grace: c.grace}
+		if c.grace > 0 {
+			ready, err := cleanup.softDeleteSnapshot(svc, job.snapshot, time.Now())
+			if err != nil {
+				fmt.Printf("error marking snapshot %s pending-delete. Error details - %s\n", *job.snapshot.SnapshotId, err)
+				return RCERR
+			}
+			if !ready {
+				return RCOK
+			}
+		}
+		if err := deleteSnapshot(svc, *job.snapshot.SnapshotId, time.Now().Add(time.Duration(c.timeout)*time.Minute)); err != nil {
+			fmt.Printf("error deleting snapshot %s. Error details - %s\n", *job.snapshot.SnapshotId, err)
+			return RCERR
+		}
+		fmt.Printf("Deleted snapshot %s\n", *job.snapshot.SnapshotId)
+		return RCOK
+	}
+
+	// the original has been replaced so it does not need an autocleanup tag to be deleted
+	cleanup := &AMICommand{
+		verbose:    c.verbose,
+		retire:     true,
+		amiId:      *job.image.ImageId,
+		grace:      c.grace,
+		timeout:    c.timeout,
+		policyBook: make(policyBook)}
+
+	_, rc := cleanup.cleanupImages(svc, &ec2.DescribeImagesInput{ImageIds: []*string{job.image.ImageId}})
+	return rc
+}
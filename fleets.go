@@ -0,0 +1,647 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/elasticache"
+	"github.com/aws/aws-sdk-go/service/redshift"
+)
+
+// fleetDecision records what autostop decided to do with an auto scale group or a cluster
+// and holds the function that carries out the decision
+type fleetDecision struct {
+	kind   string
+	id     string
+	action string
+	reason string
+	tags   map[string]string
+	apply  func() error
+}
+
+// parkSteps holds the functions that move a cluster in and out of its parking snapshot
+type parkSteps struct {
+	snapshot       func() error
+	deleteCluster  func() error
+	restore        func() error
+	deleteSnapshot func() error
+}
+
+// the tag holding the previous size of an auto scale group that autostop has scaled to zero
+const asgCapacityTag = "autostop-capacity"
+
+// the prefix of the snapshots autostop parks stopped clusters in
+const parkPrefix = "autostop-"
+
+// the action that removes the parking snapshot of a cluster that is running again. It is
+// carried out whether or not autostop is starting so a stale snapshot is never left behind
+const actionUnpark = "unpark"
+
+// fleetDecisions gathers the decisions for each of the fleet types selected
+func fleetDecisions(svc *ec2.EC2, asg, cache, warehouse bool, now time.Time, holidays holidayCalendar) (decisions []*fleetDecision, err error) {
+
+	region := safeString(svc.Config.Region)
+
+	if asg {
+		// Create an Autoscaling service object
+		// config values keys, sercet key & region read from environment
+		assvc := autoscaling.New(session.New(), &aws.Config{MaxRetries: aws.Int(10)})
+
+		d, err := asgDecisions(assvc, now, holidays)
+		if err != nil {
+			return nil, fmt.Errorf("auto scale groups - %s", err)
+		}
+		decisions = append(decisions, d...)
+	}
+
+	if cache {
+		// the account number is needed to build the ARNs used to tag ElastiCache resources
+		account, err := accountId(svc)
+		if err != nil {
+			return nil, fmt.Errorf("unable to find account number - %s", err)
+		}
+
+		// Create an ElastiCache service object
+		// config values keys, sercet key & region read from environment
+		ecsvc := elasticache.New(session.New(), &aws.Config{MaxRetries: aws.Int(10)})
+
+		d, err := elasticacheDecisions(ecsvc, region, account, now, holidays)
+		if err != nil {
+			return nil, fmt.Errorf("elasticache - %s", err)
+		}
+		decisions = append(decisions, d...)
+	}
+
+	if warehouse {
+		// Create a Redshift service object
+		// config values keys, sercet key & region read from environment
+		rssvc := redshift.New(session.New(), &aws.Config{MaxRetries: aws.Int(10)})
+
+		d, err := redshiftDecisions(rssvc, region, now, holidays)
+		if err != nil {
+			return nil, fmt.Errorf("redshift - %s", err)
+		}
+		decisions = append(decisions, d...)
+	}
+
+	return decisions, nil
+}
+
+// asgDecisions decides what needs to happen to each auto scale group with an autostop tag.
+// Stopped groups are scaled to zero with the previous min,desired,max sizes saved in a tag
+// and restored from that tag when they are started
+func asgDecisions(svc *autoscaling.AutoScaling, now time.Time, holidays holidayCalendar) (decisions []*fleetDecision, err error) {
+
+	err = svc.DescribeAutoScalingGroupsPages(nil, func(p *autoscaling.DescribeAutoScalingGroupsOutput, lastPage bool) bool {
+		for _, group := range p.AutoScalingGroups {
+
+			tags := make(map[string]string, len(group.Tags))
+			for _, tag := range group.Tags {
+				tags[safeString(tag.Key)] = safeString(tag.Value)
+			}
+
+			if _, ok := tags["autostop"]; !ok {
+				continue
+			}
+
+			d := &fleetDecision{kind: "asg", id: *group.AutoScalingGroupName, tags: tags}
+			decisions = append(decisions, d)
+
+			state := ec2.InstanceStateNameRunning
+			if _, ok := tags[asgCapacityTag]; ok {
+				state = ec2.InstanceStateNameStopped
+			}
+
+			d.action, d.reason = decideTags(tags, state, now, holidays)
+
+			switch d.action {
+			case actionStop:
+				d.apply = stopASG(svc, group)
+			case actionStart:
+				min, desired, max, err := parseCapacity(tags[asgCapacityTag])
+				if err != nil {
+					d.action = actionSkip
+					d.reason = fmt.Sprintf("invalid %s tag: %s", asgCapacityTag, err)
+					continue
+				}
+				d.apply = startASG(svc, group.AutoScalingGroupName, min, desired, max)
+			}
+		}
+		return true
+	})
+
+	return decisions, err
+}
+
+// stopASG returns a function that saves the current size of the group in a tag then scales it to zero
+func stopASG(svc *autoscaling.AutoScaling, group *autoscaling.Group) func() error {
+	return func() error {
+
+		ascouti := autoscaling.CreateOrUpdateTagsInput{
+			Tags: []*autoscaling.Tag{
+				&autoscaling.Tag{
+					ResourceId:        group.AutoScalingGroupName,
+					ResourceType:      aws.String("auto-scaling-group"),
+					Key:               aws.String(asgCapacityTag),
+					Value:             aws.String(fmt.Sprintf("%d,%d,%d", *group.MinSize, *group.DesiredCapacity, *group.MaxSize)),
+					PropagateAtLaunch: aws.Bool(false)}}}
+
+		// save the size first so it is never lost
+		if _, err := svc.CreateOrUpdateTags(&ascouti); err != nil {
+			return err
+		}
+
+		asuasgi := autoscaling.UpdateAutoScalingGroupInput{
+			AutoScalingGroupName: group.AutoScalingGroupName,
+			MinSize:              aws.Int64(0),
+			DesiredCapacity:      aws.Int64(0),
+			MaxSize:              aws.Int64(0)}
+
+		_, err := svc.UpdateAutoScalingGroup(&asuasgi)
+		return err
+	}
+}
+
+// startASG returns a function that restores the size of the group and removes the saved size tag
+func startASG(svc *autoscaling.AutoScaling, name *string, min, desired, max int64) func() error {
+	return func() error {
+
+		asuasgi := autoscaling.UpdateAutoScalingGroupInput{
+			AutoScalingGroupName: name,
+			MinSize:              aws.Int64(min),
+			DesiredCapacity:      aws.Int64(desired),
+			MaxSize:              aws.Int64(max)}
+
+		if _, err := svc.UpdateAutoScalingGroup(&asuasgi); err != nil {
+			return err
+		}
+
+		asdti := autoscaling.DeleteTagsInput{
+			Tags: []*autoscaling.Tag{
+				&autoscaling.Tag{
+					ResourceId:   name,
+					ResourceType: aws.String("auto-scaling-group"),
+					Key:          aws.String(asgCapacityTag)}}}
+
+		_, err := svc.DeleteTags(&asdti)
+		return err
+	}
+}
+
+// parseCapacity converts the min,desired,max value of the saved size tag
+func parseCapacity(value string) (min, desired, max int64, err error) {
+
+	parts := strings.Split(value, ",")
+	if len(parts) != 3 {
+		return 0, 0, 0, fmt.Errorf("expected min,desired,max but found %q", value)
+	}
+
+	sizes := make([]int64, 3)
+	for i, part := range parts {
+		if sizes[i], err = strconv.ParseInt(strings.TrimSpace(part), 10, 64); err != nil {
+			return 0, 0, 0, fmt.Errorf("expected min,desired,max but found %q", value)
+		}
+	}
+	return sizes[0], sizes[1], sizes[2], nil
+}
+
+// decidePark works out the next step for a cluster that autostop parks in a snapshot while it
+// is stopped. Each run moves the cluster one step so a frequent cron run completes the move.
+// clusterStatus or snapshotStatus are empty if the cluster or parking snapshot does not exist.
+// parked is true if the parking snapshot was taken after the cluster was last created or restored.
+// The cluster is only removed once it is parked so a snapshot left from an earlier cycle is
+// replaced rather than trusted
+func decidePark(kind, id, clusterStatus, snapshotStatus string, parked bool, tags map[string]string, now time.Time, holidays holidayCalendar, steps parkSteps) *fleetDecision {
+
+	d := &fleetDecision{kind: kind, id: id, tags: tags}
+
+	state := ec2.InstanceStateNameStopped
+	if len(clusterStatus) > 0 {
+		state = ec2.InstanceStateNameRunning
+	}
+
+	action, reason := decideTags(tags, state, now, holidays)
+	d.action, d.reason = action, reason
+
+	switch {
+	case action == actionSkip:
+	case len(clusterStatus) > 0 && clusterStatus != "available",
+		len(snapshotStatus) > 0 && snapshotStatus != "available":
+		d.action = actionNone
+		d.reason = fmt.Sprintf("waiting for cluster status %q and snapshot status %q to be available", clusterStatus, snapshotStatus)
+	case len(clusterStatus) > 0 && action == actionStop && len(snapshotStatus) == 0:
+		d.reason = "creating parking snapshot " + parkPrefix + id + ". " + reason
+		d.apply = steps.snapshot
+	case len(clusterStatus) > 0 && action == actionStop && !parked:
+		d.reason = "removing stale parking snapshot " + parkPrefix + id + " taken before the cluster was last restored. " + reason
+		d.apply = steps.deleteSnapshot
+	case len(clusterStatus) > 0 && action == actionStop:
+		d.reason = "removing cluster now parked in snapshot " + parkPrefix + id + ". " + reason
+		d.apply = steps.deleteCluster
+	case len(clusterStatus) > 0 && len(snapshotStatus) > 0:
+		// the cluster is back so the parking snapshot is no longer needed
+		d.action = actionUnpark
+		d.reason = "removing parking snapshot " + parkPrefix + id + " of restored cluster"
+		d.apply = steps.deleteSnapshot
+	case len(clusterStatus) == 0 && action == actionStart:
+		d.reason = "restoring cluster from parking snapshot " + parkPrefix + id + ". " + reason
+		d.apply = steps.restore
+	}
+
+	return d
+}
+
+// elasticacheDecisions decides what needs to happen to each ElastiCache cluster with an autostop tag.
+// Only single node group redis clusters can be parked in a snapshot. The autostop tags and security
+// groups of the cluster are saved on the snapshot so the cluster can be restored from it
+func elasticacheDecisions(svc *elasticache.ElastiCache, region, account string, now time.Time, holidays holidayCalendar) (decisions []*fleetDecision, err error) {
+
+	clusterArn := func(id string) *string {
+		return aws.String(fmt.Sprintf("arn:aws:elasticache:%s:%s:cluster:%s", region, account, id))
+	}
+	snapshotArn := func(id string) *string {
+		return aws.String(fmt.Sprintf("arn:aws:elasticache:%s:%s:snapshot:%s", region, account, parkPrefix+id))
+	}
+	listTags := func(arn *string) (map[string]string, error) {
+		resp, err := svc.ListTagsForResource(&elasticache.ListTagsForResourceInput{ResourceName: arn})
+		if err != nil {
+			return nil, err
+		}
+		tags := make(map[string]string, len(resp.TagList))
+		for _, tag := range resp.TagList {
+			tags[safeString(tag.Key)] = safeString(tag.Value)
+		}
+		return tags, nil
+	}
+
+	clusters := make(map[string]*elasticache.CacheCluster)
+	snapshots := make(map[string]*elasticache.Snapshot)
+	ids := make(map[string]bool)
+
+	err = svc.DescribeCacheClustersPages(nil, func(p *elasticache.DescribeCacheClustersOutput, lastPage bool) bool {
+		for _, cluster := range p.CacheClusters {
+			clusters[*cluster.CacheClusterId] = cluster
+			ids[*cluster.CacheClusterId] = true
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ecdsi := elasticache.DescribeSnapshotsInput{SnapshotSource: aws.String("manual")}
+	err = svc.DescribeSnapshotsPages(&ecdsi, func(p *elasticache.DescribeSnapshotsOutput, lastPage bool) bool {
+		for _, snapshot := range p.Snapshots {
+			if strings.HasPrefix(safeString(snapshot.SnapshotName), parkPrefix) {
+				snapshots[strings.TrimPrefix(*snapshot.SnapshotName, parkPrefix)] = snapshot
+				ids[strings.TrimPrefix(*snapshot.SnapshotName, parkPrefix)] = true
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range sortedIds(ids) {
+
+		id := id
+		cluster, snapshot := clusters[id], snapshots[id]
+		var clusterStatus, snapshotStatus string
+		var tags map[string]string
+
+		// tags come from the cluster while it exists and from the parking snapshot once it has gone
+		if cluster != nil {
+			clusterStatus = safeString(cluster.CacheClusterStatus)
+			tags, err = listTags(clusterArn(id))
+		} else {
+			tags, err = listTags(snapshotArn(id))
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := tags["autostop"]; !ok {
+			continue
+		}
+
+		if snapshot != nil {
+			snapshotStatus = safeString(snapshot.SnapshotStatus)
+		}
+
+		if cluster != nil && (safeString(cluster.Engine) != "redis" || cluster.ReplicationGroupId != nil) {
+			decisions = append(decisions, &fleetDecision{kind: "elasticache", id: id, tags: tags, action: actionSkip,
+				reason: "only redis clusters outside a replication group can be autostopped"})
+			continue
+		}
+
+		steps := parkSteps{
+			snapshot: func() error {
+				_, err := svc.CreateSnapshot(&elasticache.CreateSnapshotInput{
+					CacheClusterId: cluster.CacheClusterId,
+					SnapshotName:   aws.String(parkPrefix + id)})
+				if err != nil {
+					return err
+				}
+
+				var sgs []string
+				for _, sg := range cluster.SecurityGroups {
+					sgs = append(sgs, safeString(sg.SecurityGroupId))
+				}
+
+				ecTags := []*elasticache.Tag{&elasticache.Tag{
+					Key:   aws.String("autostop-security-groups"),
+					Value: aws.String(strings.Join(sgs, ","))}}
+				for k, v := range tags {
+					ecTags = append(ecTags, &elasticache.Tag{Key: aws.String(k), Value: aws.String(v)})
+				}
+
+				_, err = svc.AddTagsToResource(&elasticache.AddTagsToResourceInput{
+					ResourceName: snapshotArn(id),
+					Tags:         ecTags})
+				return err
+			},
+			deleteCluster: func() error {
+				_, err := svc.DeleteCacheCluster(&elasticache.DeleteCacheClusterInput{CacheClusterId: aws.String(id)})
+				return err
+			},
+			restore: func() error {
+				var ecTags []*elasticache.Tag
+				for k, v := range tags {
+					if k != "autostop-security-groups" {
+						ecTags = append(ecTags, &elasticache.Tag{Key: aws.String(k), Value: aws.String(v)})
+					}
+				}
+
+				_, err := svc.CreateCacheCluster(&elasticache.CreateCacheClusterInput{
+					CacheClusterId:             aws.String(id),
+					SnapshotName:               snapshot.SnapshotName,
+					CacheNodeType:              snapshot.CacheNodeType,
+					Engine:                     snapshot.Engine,
+					EngineVersion:              snapshot.EngineVersion,
+					NumCacheNodes:              snapshot.NumCacheNodes,
+					CacheParameterGroupName:    snapshot.CacheParameterGroupName,
+					CacheSubnetGroupName:       snapshot.CacheSubnetGroupName,
+					Port:                       snapshot.Port,
+					PreferredAvailabilityZone:  snapshot.PreferredAvailabilityZone,
+					PreferredMaintenanceWindow: snapshot.PreferredMaintenanceWindow,
+					SecurityGroupIds:           splitIds(tags["autostop-security-groups"]),
+					Tags:                       ecTags})
+				return err
+			},
+			deleteSnapshot: func() error {
+				_, err := svc.DeleteSnapshot(&elasticache.DeleteSnapshotInput{SnapshotName: aws.String(parkPrefix + id)})
+				return err
+			},
+		}
+
+		// a cluster restored from its parking snapshot is a new cluster created after the snapshot
+		parked := false
+		if cluster != nil && snapshot != nil && cluster.CacheClusterCreateTime != nil {
+			parked = len(snapshot.NodeSnapshots) > 0
+			for _, node := range snapshot.NodeSnapshots {
+				parked = parked && node.SnapshotCreateTime != nil && node.SnapshotCreateTime.After(*cluster.CacheClusterCreateTime)
+			}
+		}
+
+		decisions = append(decisions, decidePark("elasticache", id, clusterStatus, snapshotStatus, parked, tags, now, holidays, steps))
+	}
+
+	return decisions, nil
+}
+
+// redshiftDecisions decides what needs to happen to each Redshift cluster with an autostop tag.
+// The tags and network settings of the cluster are saved on its parking snapshot so the
+// cluster can be restored from it
+func redshiftDecisions(svc *redshift.Redshift, region string, now time.Time, holidays holidayCalendar) (decisions []*fleetDecision, err error) {
+
+	clusters := make(map[string]*redshift.Cluster)
+	snapshots := make(map[string]*redshift.Snapshot)
+	ids := make(map[string]bool)
+
+	var marker *string
+	for {
+		resp, err := svc.DescribeClusters(&redshift.DescribeClustersInput{Marker: marker})
+		if err != nil {
+			return nil, err
+		}
+		for _, cluster := range resp.Clusters {
+			clusters[*cluster.ClusterIdentifier] = cluster
+			ids[*cluster.ClusterIdentifier] = true
+		}
+		if marker = resp.Marker; marker == nil {
+			break
+		}
+	}
+
+	rdcsi := redshift.DescribeClusterSnapshotsInput{
+		SnapshotType: aws.String("manual"),
+		TagKeys:      []*string{aws.String("autostop-cluster")}}
+	err = svc.DescribeClusterSnapshotsPages(&rdcsi, func(p *redshift.DescribeClusterSnapshotsOutput, lastPage bool) bool {
+		for _, snapshot := range p.Snapshots {
+			if strings.HasPrefix(safeString(snapshot.SnapshotIdentifier), parkPrefix) {
+				snapshots[strings.TrimPrefix(*snapshot.SnapshotIdentifier, parkPrefix)] = snapshot
+				ids[strings.TrimPrefix(*snapshot.SnapshotIdentifier, parkPrefix)] = true
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// tags on the parking snapshot that are settings rather than tags of the cluster
+	settings := map[string]bool{
+		"autostop-cluster":         true,
+		"autostop-subnet-group":    true,
+		"autostop-parameter-group": true,
+		"autostop-security-groups": true,
+		"autostop-public":          true,
+	}
+
+	for _, id := range sortedIds(ids) {
+
+		id := id
+		cluster, snapshot := clusters[id], snapshots[id]
+		var clusterStatus, snapshotStatus string
+		tags := make(map[string]string)
+
+		// tags come from the cluster while it exists and from the parking snapshot once it has gone
+		if cluster != nil {
+			clusterStatus = safeString(cluster.ClusterStatus)
+			for _, tag := range cluster.Tags {
+				tags[safeString(tag.Key)] = safeString(tag.Value)
+			}
+		} else {
+			for _, tag := range snapshot.Tags {
+				tags[safeString(tag.Key)] = safeString(tag.Value)
+			}
+		}
+
+		if _, ok := tags["autostop"]; !ok {
+			continue
+		}
+
+		if snapshot != nil {
+			snapshotStatus = safeString(snapshot.Status)
+		}
+
+		steps := parkSteps{
+			snapshot: func() error {
+				var sgs []string
+				for _, sg := range cluster.VpcSecurityGroups {
+					sgs = append(sgs, safeString(sg.VpcSecurityGroupId))
+				}
+				var paramGroup string
+				if len(cluster.ClusterParameterGroups) > 0 {
+					paramGroup = safeString(cluster.ClusterParameterGroups[0].ParameterGroupName)
+				}
+
+				rsTags := []*redshift.Tag{
+					&redshift.Tag{Key: aws.String("autostop-cluster"), Value: aws.String(id)},
+					&redshift.Tag{Key: aws.String("autostop-subnet-group"), Value: cluster.ClusterSubnetGroupName},
+					&redshift.Tag{Key: aws.String("autostop-parameter-group"), Value: aws.String(paramGroup)},
+					&redshift.Tag{Key: aws.String("autostop-security-groups"), Value: aws.String(strings.Join(sgs, ","))},
+					&redshift.Tag{Key: aws.String("autostop-public"), Value: aws.String(strconv.FormatBool(aws.BoolValue(cluster.PubliclyAccessible)))}}
+				for k, v := range tags {
+					rsTags = append(rsTags, &redshift.Tag{Key: aws.String(k), Value: aws.String(v)})
+				}
+
+				_, err := svc.CreateClusterSnapshot(&redshift.CreateClusterSnapshotInput{
+					ClusterIdentifier:  aws.String(id),
+					SnapshotIdentifier: aws.String(parkPrefix + id),
+					Tags:               rsTags})
+				return err
+			},
+			deleteCluster: func() error {
+				_, err := svc.DeleteCluster(&redshift.DeleteClusterInput{
+					ClusterIdentifier:        aws.String(id),
+					SkipFinalClusterSnapshot: aws.Bool(true)})
+				return err
+			},
+			restore: func() error {
+				rrfcsi := redshift.RestoreFromClusterSnapshotInput{
+					ClusterIdentifier:   aws.String(id),
+					SnapshotIdentifier:  snapshot.SnapshotIdentifier,
+					AvailabilityZone:    snapshot.AvailabilityZone,
+					NodeType:            snapshot.NodeType,
+					Port:                snapshot.Port,
+					PubliclyAccessible:  aws.Bool(tags["autostop-public"] == "true"),
+					VpcSecurityGroupIds: splitIds(tags["autostop-security-groups"])}
+				if len(tags["autostop-subnet-group"]) > 0 {
+					rrfcsi.ClusterSubnetGroupName = aws.String(tags["autostop-subnet-group"])
+				}
+				if len(tags["autostop-parameter-group"]) > 0 {
+					rrfcsi.ClusterParameterGroupName = aws.String(tags["autostop-parameter-group"])
+				}
+
+				if _, err := svc.RestoreFromClusterSnapshot(&rrfcsi); err != nil {
+					return err
+				}
+
+				var rsTags []*redshift.Tag
+				for k, v := range tags {
+					if !settings[k] {
+						rsTags = append(rsTags, &redshift.Tag{Key: aws.String(k), Value: aws.String(v)})
+					}
+				}
+
+				_, err := svc.CreateTags(&redshift.CreateTagsInput{
+					ResourceName: aws.String(fmt.Sprintf("arn:aws:redshift:%s:%s:cluster:%s", region, safeString(snapshot.OwnerAccount), id)),
+					Tags:         rsTags})
+				return err
+			},
+			deleteSnapshot: func() error {
+				_, err := svc.DeleteClusterSnapshot(&redshift.DeleteClusterSnapshotInput{
+					SnapshotIdentifier: aws.String(parkPrefix + id)})
+				return err
+			},
+		}
+
+		// a cluster restored from its parking snapshot is a new cluster created after the snapshot
+		parked := cluster != nil && snapshot != nil && cluster.ClusterCreateTime != nil &&
+			snapshot.SnapshotCreateTime != nil && snapshot.SnapshotCreateTime.After(*cluster.ClusterCreateTime)
+
+		decisions = append(decisions, decidePark("redshift", id, clusterStatus, snapshotStatus, parked, tags, now, holidays, steps))
+	}
+
+	return decisions, nil
+}
+
+// applyFleet carries out the fleet decisions, logging each one with its reason and recording
+// the changes in the journal. Start decisions are only carried out if start is true
+func applyFleet(decisions []*fleetDecision, start, dryrun, verbose bool, journal, command, region string) int {
+
+	rc := RCOK
+	var entries []*journalEntry
+
+	for _, d := range decisions {
+
+		switch {
+		case d.action == actionStart && !start:
+			continue
+		case d.action == actionNone && !verbose:
+			continue
+		case d.apply == nil || dryrun:
+			if dryrun && d.apply != nil {
+				fmt.Printf("Dry Run - Would have taken action %s on %s %s: %s\n", d.action, d.kind, d.id, d.reason)
+			} else {
+				fmt.Printf("Info - %s %s action: %s reason: %s\n", d.kind, d.id, d.action, d.reason)
+			}
+			continue
+		}
+
+		if err := d.apply(); err != nil {
+			fmt.Printf("Error - unable to %s %s %s: %s\n", d.action, d.kind, d.id, err)
+			rc = RCERR
+			continue
+		}
+
+		fmt.Printf("Info - %s %s action: %s reason: %s\n", d.kind, d.id, d.action, d.reason)
+
+		entries = append(entries, &journalEntry{
+			Time:         time.Now().UTC(),
+			Command:      command,
+			Action:       d.action,
+			ResourceType: d.kind,
+			ResourceId:   d.id,
+			Region:       region,
+			Reason:       d.reason,
+			Tags:         d.tags,
+		})
+	}
+
+	if err := writeJournal(journal, entries); err != nil {
+		fmt.Printf("Warning - unable to write to journal %s: %s\n", journal, err)
+	}
+
+	return rc
+}
+
+// sortedIds returns the ids in the set in sorted order
+func sortedIds(set map[string]bool) []string {
+	var ids []string
+	for id := range set {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// splitIds converts a comma separated list of ids into a slice for the AWS api
+func splitIds(value string) []*string {
+	var ids []*string
+	for _, id := range strings.Split(value, ",") {
+		if id = strings.TrimSpace(id); len(id) > 0 {
+			ids = append(ids, aws.String(id))
+		}
+	}
+	return ids
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// holidayCalendar holds the dates, in 2006-01-02 format, that count as stop days
+type holidayCalendar map[string]bool
+
+// loadHolidays reads a holiday calendar file. The file can either be an iCal file
+// where every VEVENT is a holiday or a simple list with one 2006-01-02 date per line.
+// Blank lines and lines starting with # are ignored in the simple list.
+func loadHolidays(filename string) (holidayCalendar, error) {
+
+	holidays := make(holidayCalendar)
+
+	if len(filename) == 0 {
+		return holidays, nil
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var start, end time.Time
+	ical := false
+	lineNo := 0
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if line == "BEGIN:VCALENDAR" {
+			ical = true
+			continue
+		}
+
+		if !ical {
+			day, err := time.Parse("2006-01-02", line)
+			if err != nil {
+				return nil, fmt.Errorf("%s line %d: invalid date %q. Expected YYYY-MM-DD", filename, lineNo, line)
+			}
+			holidays[day.Format("2006-01-02")] = true
+			continue
+		}
+
+		switch {
+		case line == "BEGIN:VEVENT":
+			start, end = time.Time{}, time.Time{}
+		case strings.HasPrefix(line, "DTSTART"):
+			if start, err = icalDate(line); err != nil {
+				return nil, fmt.Errorf("%s line %d: %s", filename, lineNo, err)
+			}
+		case strings.HasPrefix(line, "DTEND"):
+			if end, err = icalDate(line); err != nil {
+				return nil, fmt.Errorf("%s line %d: %s", filename, lineNo, err)
+			}
+		case line == "END:VEVENT":
+			if start.IsZero() {
+				continue
+			}
+			// all day events have an exclusive end date
+			if !end.After(start) {
+				end = start.AddDate(0, 0, 1)
+			}
+			for day := start; day.Before(end); day = day.AddDate(0, 0, 1) {
+				holidays[day.Format("2006-01-02")] = true
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return holidays, nil
+}
+
+// icalDate extracts the date from an iCal DTSTART or DTEND line such as
+// DTSTART;VALUE=DATE:20261225 or DTSTART:20261225T000000Z
+func icalDate(line string) (time.Time, error) {
+
+	i := strings.LastIndex(line, ":")
+	if i < 0 || len(line[i+1:]) < 8 {
+		return time.Time{}, fmt.Errorf("invalid iCal date line %q", line)
+	}
+
+	day, err := time.Parse("20060102", line[i+1:i+9])
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid iCal date line %q", line)
+	}
+	return day, nil
+}
+
+// isHoliday reports if the date of the time provided is in the calendar
+func (h holidayCalendar) isHoliday(t time.Time) bool {
+	return h[t.Format("2006-01-02")]
+}
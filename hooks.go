@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+// snapshotHook holds the commands run on an instance with SSM around CreateImage
+type snapshotHook struct {
+	Pre      string `json:"pre"`
+	Post     string `json:"post"`
+	Document string `json:"document"`
+}
+
+// hookConfig holds the hooks from the hook file keyed by instance id or Name tag
+type hookConfig map[string]*snapshotHook
+
+// loadHooks reads a json hook file in the form
+// {"i-0123 or Name": {"pre": "command", "post": "command", "document": "AWS-RunShellScript"}}
+func loadHooks(filename string) (hookConfig, error) {
+
+	hooks := make(hookConfig)
+
+	if len(filename) == 0 {
+		return hooks, nil
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if err := json.NewDecoder(f).Decode(&hooks); err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	return hooks, nil
+}
+
+// forInstance returns the hooks of an instance. The autobkup-pre-hook, autobkup-post-hook and
+// autobkup-hook-document tags override the hook file entry for the instance id or Name tag
+func (h hookConfig) forInstance(instanceId string, tags []*ec2.Tag) *snapshotHook {
+
+	hook := &snapshotHook{}
+	if configured := h[instanceId]; configured != nil {
+		*hook = *configured
+	} else if configured := h[tagValue(tags, "Name")]; configured != nil {
+		*hook = *configured
+	}
+
+	if pre := tagValue(tags, "autobkup-pre-hook"); len(pre) > 0 {
+		hook.Pre = pre
+	}
+	if post := tagValue(tags, "autobkup-post-hook"); len(post) > 0 {
+		hook.Post = post
+	}
+	if document := tagValue(tags, "autobkup-hook-document"); len(document) > 0 {
+		hook.Document = document
+	}
+	if len(hook.Document) == 0 {
+		hook.Document = "AWS-RunShellScript"
+	}
+	return hook
+}
+
+// runHook runs a command on an instance with SSM SendCommand and waits for it to finish.
+// It returns an error if the command does not succeed before the timeout
+func runHook(ssmsvc *ssm.SSM, instanceId string, document string, command string, timeout time.Duration) error {
+
+	// SSM will not accept a timeout under 30 seconds
+	timeoutSeconds := int64(timeout.Seconds())
+	if timeoutSeconds < 30 {
+		timeoutSeconds = 30
+	}
+
+	ssmsci := ssm.SendCommandInput{
+		DocumentName:   aws.String(document),
+		InstanceIds:    []*string{aws.String(instanceId)},
+		Comment:        aws.String("awsgo-tools snapshot hook"),
+		TimeoutSeconds: aws.Int64(timeoutSeconds),
+		Parameters: map[string][]*string{
+			"commands":         []*string{aws.String(command)},
+			"executionTimeout": []*string{aws.String(fmt.Sprintf("%d", timeoutSeconds))}}}
+
+	sendResp, err := ssmsvc.SendCommand(&ssmsci)
+	if err != nil {
+		return err
+	}
+
+	commandId := sendResp.Command.CommandId
+	deadline := time.Now().Add(timeout)
+
+	for {
+		time.Sleep(5 * time.Second)
+
+		ssmlcii := ssm.ListCommandInvocationsInput{
+			CommandId:  commandId,
+			InstanceId: aws.String(instanceId),
+			Details:    aws.Bool(true)}
+
+		listResp, err := ssmsvc.ListCommandInvocations(&ssmlcii)
+		if err != nil {
+			return err
+		}
+
+		if len(listResp.CommandInvocations) > 0 {
+			invocation := listResp.CommandInvocations[0]
+			switch safeString(invocation.Status) {
+			case ssm.CommandInvocationStatusSuccess:
+				return nil
+			case ssm.CommandInvocationStatusFailed, ssm.CommandInvocationStatusTimedOut,
+				ssm.CommandInvocationStatusCancelled:
+				return fmt.Errorf("command %s %s%s", *commandId, safeString(invocation.Status), hookOutput(invocation))
+			}
+		}
+
+		if time.Now().After(deadline) {
+			ssmsvc.CancelCommand(&ssm.CancelCommandInput{CommandId: commandId})
+			return fmt.Errorf("command %s did not finish within %s", *commandId, timeout)
+		}
+	}
+}
+
+// hookOutput returns the output of the first plugin of a failed command for the error message
+func hookOutput(invocation *ssm.CommandInvocation) string {
+	for _, plugin := range invocation.CommandPlugins {
+		if output := safeString(plugin.Output); len(output) > 0 {
+			return ": " + output
+		}
+	}
+	return ""
+}
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/mitchellh/cli"
+)
+
+type IAMHygieneCommand struct {
+	verbose     bool
+	dryrun      bool
+	keyDays     int
+	deleteDays  int
+	loginDays   int
+	exclude     string
+	journal     string
+	entries     []*journalEntry
+	deactivated map[string]time.Time // when each access key was deactivated, from the journal
+	Ui          cli.Ui
+}
+
+// the journal actions recording an inactive access key that was not deactivated by iam-hygiene
+// and a deactivated key that has been made active again
+const (
+	actionSeenInactive = "seen-inactive"
+	actionReactivated  = "reactivated"
+)
+
+// Help function displays detailed help for the iam-hygiene sub command
+func (c *IAMHygieneCommand) Help() string {
+	return `
+	Description:
+	Act on stale IAM credentials or offboard a user.
+
+	Access keys unused for --key-days are deactivated and keys that have been
+	inactive for --delete-days are deleted, so a key is first deactivated and only
+	deleted once it has been inactive that long. The time each key was deactivated
+	is read from the journal so --delete-days needs --journal. An inactive key
+	not in the journal is recorded the first time it is seen and counts from then.
+	A key found active again is recorded as reactivated and starts over.
+	Login profiles unused for --login-days are removed. Keys and passwords that
+	have never been used count from when they were created.
+
+	Offboard removes the user from its groups, detaches and deletes its policies,
+	deletes its access keys, MFA devices, SSH keys, signing certificates and login
+	profile and then deletes the user.
+
+	Usage:
+		awsgo-tools iam-hygiene [flags]
+		awsgo-tools iam-hygiene offboard [flags] <user>
+
+	Flags:
+	--key-days <days> - deactivate access keys unused for this many days
+	--delete-days <days> - delete access keys inactive for this many days.
+		needs --journal
+	--login-days <days> - remove login profiles unused for this many days
+	--exclude <users> - comma separated users to leave alone such as break glass users
+	--journal <file> - append every change to this journal file
+	-n - Dry run. Report what would have happened but make no changes
+	-v - Produce verbose output
+	`
+}
+
+// Synopsis function returns a string with concise details of the sub command
+func (c *IAMHygieneCommand) Synopsis() string {
+	return "Deactivate stale IAM credentials & offboard users"
+}
+
+// Run function is the function called by the cli library to run the actual sub command code.
+func (c *IAMHygieneCommand) Run(args []string) int {
+
+	offboard := len(args) > 0 && args[0] == "offboard"
+	if offboard {
+		args = args[1:]
+	}
+
+	cmdFlags := flag.NewFlagSet("iam-hygiene", flag.ContinueOnError)
+	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+
+	cmdFlags.BoolVar(&c.verbose, "v", false, "Produce verbose output")
+	cmdFlags.BoolVar(&c.dryrun, "n", false, "Dry Run")
+	cmdFlags.IntVar(&c.keyDays, "key-days", 0, "Deactivate access keys unused for this many days")
+	cmdFlags.IntVar(&c.deleteDays, "delete-days", 0, "Delete access keys inactive for this many days")
+	cmdFlags.IntVar(&c.loginDays, "login-days", 0, "Remove login profiles unused for this many days")
+	cmdFlags.StringVar(&c.exclude, "exclude", "", "Users to leave alone")
+	cmdFlags.StringVar(&c.journal, "journal", "", "Journal file to record changes in")
+	if err := cmdFlags.Parse(args); err != nil {
+		return RCERR
+	}
+
+	if offboard && cmdFlags.NArg() != 1 {
+		fmt.Printf("Please provide the one user to offboard\n")
+		return RCERR
+	}
+	if !offboard && c.keyDays <= 0 && c.deleteDays <= 0 && c.loginDays <= 0 {
+		fmt.Printf("Nothing to do. Please provide --key-days, --delete-days or --login-days\nor use offboard <user>.\n")
+		return RCERR
+	}
+	if !offboard && c.deleteDays > 0 && len(c.journal) == 0 {
+		fmt.Printf("--delete-days needs --journal to record when access keys were deactivated\n")
+		return RCERR
+	}
+
+	// Create an IAM service object
+	// Config details Keys, secret keys and region will be read from environment
+	svc := iam.New(session.New(), &aws.Config{MaxRetries: aws.Int(10)})
+
+	var rc int
+	if offboard {
+		rc = c.offboardUser(svc, cmdFlags.Arg(0))
+	} else {
+		rc = c.staleCredentials(svc)
+	}
+
+	if err := writeJournal(c.journal, c.entries); err != nil {
+		fmt.Printf("Warning - unable to write to journal %s: %s\n", c.journal, err)
+	}
+	return rc
+}
+
+// staleCredentials deactivates or deletes the stale access keys and removes the stale login
+// profiles of every user not excluded
+func (c *IAMHygieneCommand) staleCredentials(svc *iam.IAM) int {
+
+	excluded := make(map[string]bool)
+	for _, user := range splitIds(c.exclude) {
+		excluded[*user] = true
+	}
+
+	if len(c.journal) > 0 {
+		var err error
+		if c.deactivated, err = keyDeactivations(c.journal); err != nil {
+			fmt.Printf("Fatal error: unable to read journal %s - %s\n", c.journal, err)
+			return RCERR
+		}
+	}
+
+	var users []*iam.User
+	err := svc.ListUsersPages(&iam.ListUsersInput{}, func(p *iam.ListUsersOutput, lastPage bool) bool {
+		users = append(users, p.Users...)
+		return true
+	})
+	if err != nil {
+		fmt.Printf("Fatal error: ListUsers - %s\n", err)
+		return RCERR
+	}
+
+	rc := RCOK
+	now := time.Now()
+
+	for _, user := range users {
+
+		if excluded[*user.UserName] {
+			if c.verbose {
+				fmt.Printf("Info - Skipping excluded user %s\n", *user.UserName)
+			}
+			continue
+		}
+
+		if err := c.staleKeys(svc, user, now); err != nil {
+			fmt.Printf("error checking access keys of %s. Error details - %s\n", *user.UserName, err)
+			rc = RCERR
+		}
+
+		if c.loginDays > 0 {
+			if err := c.staleLogin(svc, user, now); err != nil {
+				fmt.Printf("error checking login profile of %s. Error details - %s\n", *user.UserName, err)
+				rc = RCERR
+			}
+		}
+	}
+	return rc
+}
+
+// staleKeys deactivates the active access keys of a user unused for the key days and deletes
+// the keys deactivated more than the delete days ago
+func (c *IAMHygieneCommand) staleKeys(svc *iam.IAM, user *iam.User, now time.Time) error {
+
+	keysResp, err := svc.ListAccessKeys(&iam.ListAccessKeysInput{UserName: user.UserName})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keysResp.AccessKeyMetadata {
+
+		lastUsedResp, err := svc.GetAccessKeyLastUsed(&iam.GetAccessKeyLastUsedInput{AccessKeyId: key.AccessKeyId})
+		if err != nil {
+			return err
+		}
+
+		lastUsed, used := aws.TimeValue(key.CreateDate), "never used"
+		if lastUsedResp.AccessKeyLastUsed != nil && lastUsedResp.AccessKeyLastUsed.LastUsedDate != nil {
+			lastUsed, used = *lastUsedResp.AccessKeyLastUsed.LastUsedDate, "unused"
+		}
+		unused := now.Sub(lastUsed)
+
+		switch safeString(key.Status) {
+		case iam.StatusTypeActive:
+			if _, known := c.deactivated[*key.AccessKeyId]; known {
+				c.reactivated(key)
+			}
+			if c.keyDays <= 0 || unused < days(c.keyDays) {
+				continue
+			}
+			reason := fmt.Sprintf("%s for %.0f days", used, unused.Hours()/24)
+			err = c.act("deactivate", "access-key", *key.AccessKeyId, *user.UserName, reason, func() error {
+				_, err := svc.UpdateAccessKey(&iam.UpdateAccessKeyInput{
+					UserName:    user.UserName,
+					AccessKeyId: key.AccessKeyId,
+					Status:      aws.String(iam.StatusTypeInactive)})
+				return err
+			})
+		case iam.StatusTypeInactive:
+			if c.deleteDays <= 0 {
+				continue
+			}
+			since, known := c.deactivated[*key.AccessKeyId]
+			if !known {
+				c.seenInactive(key)
+				continue
+			}
+			if inactive := now.Sub(since); inactive < days(c.deleteDays) {
+				if c.verbose {
+					fmt.Printf("Info - access key %s of user %s inactive for %.0f days\n", *key.AccessKeyId, *user.UserName, inactive.Hours()/24)
+				}
+				continue
+			}
+			reason := fmt.Sprintf("inactive since %s and %s for %.0f days", since.Format(time.RFC3339), used, unused.Hours()/24)
+			err = c.act("delete", "access-key", *key.AccessKeyId, *user.UserName, reason, func() error {
+				_, err := svc.DeleteAccessKey(&iam.DeleteAccessKeyInput{UserName: user.UserName, AccessKeyId: key.AccessKeyId})
+				return err
+			})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// seenInactive records an inactive access key that is not in the journal so the delete days
+// count from now
+func (c *IAMHygieneCommand) seenInactive(key *iam.AccessKeyMetadata) {
+
+	if c.verbose || c.dryrun {
+		fmt.Printf("Info - access key %s of user %s is inactive but not in the journal. Recording it now\n", *key.AccessKeyId, *key.UserName)
+	}
+	if c.dryrun {
+		return
+	}
+
+	c.entries = append(c.entries, &journalEntry{
+		Time:         time.Now().UTC(),
+		Command:      "iam-hygiene",
+		Action:       actionSeenInactive,
+		ResourceType: "access-key",
+		ResourceId:   *key.AccessKeyId,
+		Reason:       "inactive key not deactivated by iam-hygiene",
+		Details:      map[string]string{"user": *key.UserName}})
+}
+
+// reactivated records that a key deactivated earlier is active again so its delete days start
+// over when it is next deactivated
+func (c *IAMHygieneCommand) reactivated(key *iam.AccessKeyMetadata) {
+
+	delete(c.deactivated, *key.AccessKeyId)
+
+	if c.verbose || c.dryrun {
+		fmt.Printf("Info - access key %s of user %s has been reactivated since it was deactivated\n", *key.AccessKeyId, *key.UserName)
+	}
+	if c.dryrun {
+		return
+	}
+
+	c.entries = append(c.entries, &journalEntry{
+		Time:         time.Now().UTC(),
+		Command:      "iam-hygiene",
+		Action:       actionReactivated,
+		ResourceType: "access-key",
+		ResourceId:   *key.AccessKeyId,
+		Reason:       "deactivated key found active",
+		Details:      map[string]string{"user": *key.UserName}})
+}
+
+// keyDeactivations returns the time each access key was last deactivated or first seen inactive
+// from the journal, forgetting deactivations followed by a reactivation. A journal that does
+// not exist yet has no deactivations
+func keyDeactivations(filename string) (map[string]time.Time, error) {
+
+	deactivated := make(map[string]time.Time)
+
+	entries, err := readJournal(filename)
+	if os.IsNotExist(err) {
+		return deactivated, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if entry.Command != "iam-hygiene" || entry.ResourceType != "access-key" {
+			continue
+		}
+		switch entry.Action {
+		case "deactivate":
+			deactivated[entry.ResourceId] = entry.Time
+		case actionSeenInactive:
+			if _, ok := deactivated[entry.ResourceId]; !ok {
+				deactivated[entry.ResourceId] = entry.Time
+			}
+		case actionReactivated:
+			delete(deactivated, entry.ResourceId)
+		}
+	}
+	return deactivated, nil
+}
+
+// staleLogin removes the login profile of a user whose password has not been used for the login days
+func (c *IAMHygieneCommand) staleLogin(svc *iam.IAM, user *iam.User, now time.Time) error {
+
+	profileResp, err := svc.GetLoginProfile(&iam.GetLoginProfileInput{UserName: user.UserName})
+	if errorCode(err) == "NoSuchEntity" {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	lastUsed, used := aws.TimeValue(profileResp.LoginProfile.CreateDate), "never used"
+	if user.PasswordLastUsed != nil {
+		lastUsed, used = *user.PasswordLastUsed, "unused"
+	}
+	unused := now.Sub(lastUsed)
+
+	if unused < days(c.loginDays) {
+		return nil
+	}
+
+	reason := fmt.Sprintf("password %s for %.0f days", used, unused.Hours()/24)
+	return c.act("delete", "login-profile", *user.UserName, *user.UserName, reason, func() error {
+		_, err := svc.DeleteLoginProfile(&iam.DeleteLoginProfileInput{UserName: user.UserName})
+		return err
+	})
+}
+
+// offboardUser removes everything attached to a user and then deletes the user. It stops at the
+// first error so the user is never deleted with credentials left behind
+func (c *IAMHygieneCommand) offboardUser(svc *iam.IAM, userName string) int {
+
+	user := aws.String(userName)
+	reason := "offboard"
+
+	if _, err := svc.GetUser(&iam.GetUserInput{UserName: user}); err != nil {
+		fmt.Printf("Fatal error: GetUser %s - %s\n", userName, err)
+		return RCERR
+	}
+
+	steps := []func() error{
+		func() error {
+			groupsResp, err := svc.ListGroupsForUser(&iam.ListGroupsForUserInput{UserName: user})
+			if err != nil {
+				return err
+			}
+			for _, group := range groupsResp.Groups {
+				if err := c.act("remove-from-group", "group", *group.GroupName, userName, reason, func() error {
+					_, err := svc.RemoveUserFromGroup(&iam.RemoveUserFromGroupInput{UserName: user, GroupName: group.GroupName})
+					return err
+				}); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		func() error {
+			attachedResp, err := svc.ListAttachedUserPolicies(&iam.ListAttachedUserPoliciesInput{UserName: user})
+			if err != nil {
+				return err
+			}
+			for _, policy := range attachedResp.AttachedPolicies {
+				if err := c.act("detach", "policy", *policy.PolicyArn, userName, reason, func() error {
+					_, err := svc.DetachUserPolicy(&iam.DetachUserPolicyInput{UserName: user, PolicyArn: policy.PolicyArn})
+					return err
+				}); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		func() error {
+			inlineResp, err := svc.ListUserPolicies(&iam.ListUserPoliciesInput{UserName: user})
+			if err != nil {
+				return err
+			}
+			for _, policyName := range inlineResp.PolicyNames {
+				name := policyName
+				if err := c.act("delete", "inline-policy", *name, userName, reason, func() error {
+					_, err := svc.DeleteUserPolicy(&iam.DeleteUserPolicyInput{UserName: user, PolicyName: name})
+					return err
+				}); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		func() error {
+			keysResp, err := svc.ListAccessKeys(&iam.ListAccessKeysInput{UserName: user})
+			if err != nil {
+				return err
+			}
+			for _, key := range keysResp.AccessKeyMetadata {
+				if err := c.act("delete", "access-key", *key.AccessKeyId, userName, reason, func() error {
+					_, err := svc.DeleteAccessKey(&iam.DeleteAccessKeyInput{UserName: user, AccessKeyId: key.AccessKeyId})
+					return err
+				}); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		func() error {
+			mfaResp, err := svc.ListMFADevices(&iam.ListMFADevicesInput{UserName: user})
+			if err != nil {
+				return err
+			}
+			for _, device := range mfaResp.MFADevices {
+				if err := c.act("delete", "mfa-device", *device.SerialNumber, userName, reason, func() error {
+					if _, err := svc.DeactivateMFADevice(&iam.DeactivateMFADeviceInput{UserName: user, SerialNumber: device.SerialNumber}); err != nil {
+						return err
+					}
+					// hardware devices only need deactivating
+					if strings.HasPrefix(*device.SerialNumber, "arn:") {
+						_, err := svc.DeleteVirtualMFADevice(&iam.DeleteVirtualMFADeviceInput{SerialNumber: device.SerialNumber})
+						return err
+					}
+					return nil
+				}); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		func() error {
+			sshResp, err := svc.ListSSHPublicKeys(&iam.ListSSHPublicKeysInput{UserName: user})
+			if err != nil {
+				return err
+			}
+			for _, key := range sshResp.SSHPublicKeys {
+				if err := c.act("delete", "ssh-key", *key.SSHPublicKeyId, userName, reason, func() error {
+					_, err := svc.DeleteSSHPublicKey(&iam.DeleteSSHPublicKeyInput{UserName: user, SSHPublicKeyId: key.SSHPublicKeyId})
+					return err
+				}); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		func() error {
+			certResp, err := svc.ListSigningCertificates(&iam.ListSigningCertificatesInput{UserName: user})
+			if err != nil {
+				return err
+			}
+			for _, cert := range certResp.Certificates {
+				if err := c.act("delete", "signing-certificate", *cert.CertificateId, userName, reason, func() error {
+					_, err := svc.DeleteSigningCertificate(&iam.DeleteSigningCertificateInput{UserName: user, CertificateId: cert.CertificateId})
+					return err
+				}); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		func() error {
+			_, err := svc.GetLoginProfile(&iam.GetLoginProfileInput{UserName: user})
+			if errorCode(err) == "NoSuchEntity" {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			return c.act("delete", "login-profile", userName, userName, reason, func() error {
+				_, err := svc.DeleteLoginProfile(&iam.DeleteLoginProfileInput{UserName: user})
+				return err
+			})
+		},
+		func() error {
+			return c.act("delete", "user", userName, userName, reason, func() error {
+				_, err := svc.DeleteUser(&iam.DeleteUserInput{UserName: user})
+				return err
+			})
+		},
+	}
+
+	for _, step := range steps {
+		if err := step(); err != nil {
+			fmt.Printf("error offboarding %s. User has not been deleted. Error details - %s\n", userName, err)
+			return RCERR
+		}
+	}
+	return RCOK
+}
+
+// act reports the change in a dry run. Otherwise it makes the change and records it in the journal
+func (c *IAMHygieneCommand) act(action string, resourceType string, resourceId string, user string, reason string, change func() error) error {
+
+	if c.dryrun {
+		fmt.Printf("Dry Run - Would have %s %s %s of user %s reason: %s\n", action, resourceType, resourceId, user, reason)
+		return nil
+	}
+
+	if err := change(); err != nil {
+		return fmt.Errorf("%s %s %s: %s", action, resourceType, resourceId, err)
+	}
+	fmt.Printf("%s %s %s of user %s reason: %s\n", action, resourceType, resourceId, user, reason)
+
+	c.entries = append(c.entries, &journalEntry{
+		Time:         time.Now().UTC(),
+		Command:      "iam-hygiene",
+		Action:       action,
+		ResourceType: resourceType,
+		ResourceId:   resourceId,
+		Reason:       reason,
+		Details:      map[string]string{"user": user}})
+	return nil
+}
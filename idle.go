@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// idleThresholds holds the limits an instance must stay under to be considered idle
+type idleThresholds struct {
+	hours int     // number of whole hours the instance must have been idle
+	cpu   float64 // hourly average CPUUtilization in percent
+	netMB float64 // hourly NetworkIn plus NetworkOut in megabytes
+}
+
+// idleInstances finds the running idle mode candidates, either instances tagged autostop=idle
+// or instances with an Environment tag matching env, and decides if they have been idle
+// long enough to be stopped
+func idleInstances(svc *ec2.EC2, cwsvc *cloudwatch.CloudWatch, now time.Time, env string, limits idleThresholds) (decisions []*autoDecision, err error) {
+
+	tagFilters := []*ec2.Filter{&ec2.Filter{
+		Name:   aws.String("tag:autostop"),
+		Values: []*string{aws.String("idle")}}}
+
+	if len(env) > 0 {
+		tagFilters = append(tagFilters, &ec2.Filter{
+			Name:   aws.String("tag:Environment"),
+			Values: []*string{aws.String(env)}})
+	}
+
+	// filters are and-ed so each tag is its own query and instances found by both are merged
+	seen := make(map[string]bool)
+	var instances []*ec2.Instance
+
+	for _, tagFilter := range tagFilters {
+
+		ec2dii := ec2.DescribeInstancesInput{
+			Filters: []*ec2.Filter{
+				tagFilter,
+				&ec2.Filter{
+					Name:   aws.String("instance-state-name"),
+					Values: []*string{aws.String(ec2.InstanceStateNameRunning)}}}}
+
+		err = svc.DescribeInstancesPages(&ec2dii, func(p *ec2.DescribeInstancesOutput, lastPage bool) bool {
+			for _, reservation := range p.Reservations {
+				for _, instance := range reservation.Instances {
+					if !seen[*instance.InstanceId] {
+						seen[*instance.InstanceId] = true
+						instances = append(instances, instance)
+					}
+				}
+			}
+			return true
+		})
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, instance := range instances {
+
+		d := &autoDecision{instance: instance}
+		decisions = append(decisions, d)
+
+		if skip, reason := asgMember(instance); skip {
+			d.action, d.reason = actionSkip, reason
+			continue
+		}
+
+		if skip, reason := skipOverride(tagMap(instance.Tags), now, time.Local); skip {
+			d.action = actionSkip
+			d.reason = reason
+			continue
+		}
+
+		d.action, d.reason, err = decideIdle(cwsvc, *instance.InstanceId, now, limits)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return decisions, nil
+}
+
+// decideIdle pulls the hourly CPU and network metrics for an instance and returns
+// a stop action if every hour is under the thresholds along with the metric evidence
+func decideIdle(cwsvc *cloudwatch.CloudWatch, instanceId string, now time.Time, limits idleThresholds) (action string, reason string, err error) {
+
+	// use whole hours so each datapoint covers one full hour
+	endTime := now.Truncate(time.Hour)
+	startTime := endTime.Add(-time.Duration(limits.hours) * time.Hour)
+
+	cpu, err := instanceMetric(cwsvc, instanceId, "CPUUtilization", "Average", startTime, endTime)
+	if err != nil {
+		return "", "", err
+	}
+	netIn, err := instanceMetric(cwsvc, instanceId, "NetworkIn", "Sum", startTime, endTime)
+	if err != nil {
+		return "", "", err
+	}
+	netOut, err := instanceMetric(cwsvc, instanceId, "NetworkOut", "Sum", startTime, endTime)
+	if err != nil {
+		return "", "", err
+	}
+
+	if len(cpu) < limits.hours || len(netIn) < limits.hours || len(netOut) < limits.hours {
+		return actionNone, fmt.Sprintf("not enough metric data. CPU %d NetworkIn %d NetworkOut %d of %d hours available",
+			len(cpu), len(netIn), len(netOut), limits.hours), nil
+	}
+
+	var peakCPU, peakNet float64
+
+	for hour, value := range cpu {
+		if value > peakCPU {
+			peakCPU = value
+		}
+		if net := (netIn[hour] + netOut[hour]) / (1024 * 1024); net > peakNet {
+			peakNet = net
+		}
+	}
+
+	evidence := fmt.Sprintf("over the last %d hours peak hourly CPU %.2f%% (limit %.2f%%) peak hourly network %.2f MB (limit %.2f MB)",
+		limits.hours, peakCPU, limits.cpu, peakNet, limits.netMB)
+
+	if peakCPU < limits.cpu && peakNet < limits.netMB {
+		return actionStop, "idle " + evidence, nil
+	}
+	return actionNone, "busy " + evidence, nil
+}
+
+// instanceMetric returns one hourly statistic for an EC2 metric keyed by the start of each hour
+func instanceMetric(cwsvc *cloudwatch.CloudWatch, instanceId, metric, statistic string, startTime, endTime time.Time) (map[time.Time]float64, error) {
+
+	cwgmsi := cloudwatch.GetMetricStatisticsInput{
+		Namespace:  aws.String("AWS/EC2"),
+		MetricName: aws.String(metric),
+		Dimensions: []*cloudwatch.Dimension{
+			&cloudwatch.Dimension{
+				Name:  aws.String("InstanceId"),
+				Value: aws.String(instanceId)}},
+		StartTime:  aws.Time(startTime),
+		EndTime:    aws.Time(endTime),
+		Period:     aws.Int64(3600),
+		Statistics: []*string{aws.String(statistic)},
+	}
+
+	resp, err := cwsvc.GetMetricStatistics(&cwgmsi)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[time.Time]float64, len(resp.Datapoints))
+
+	for _, dp := range resp.Datapoints {
+		if dp.Timestamp == nil {
+			continue
+		}
+		switch statistic {
+		case "Average":
+			values[dp.Timestamp.UTC()] = aws.Float64Value(dp.Average)
+		case "Sum":
+			values[dp.Timestamp.UTC()] = aws.Float64Value(dp.Sum)
+		}
+	}
+	return values, nil
+}
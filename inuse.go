@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// imagesInUse returns the reason each AMI is still in use keyed by AMI id. An AMI is in use if
+// an instance that is not terminated was launched from it, a launch configuration references
+// it or it has launch permissions for other accounts or the public
+func imagesInUse(svc *ec2.EC2, images []*ec2.Image) (map[string]string, error) {
+
+	if len(images) == 0 {
+		return nil, nil
+	}
+	inUse := make(map[string][]string)
+
+	ids := make(map[string]bool)
+	for _, image := range images {
+		ids[*image.ImageId] = true
+	}
+
+	// there can be more AMI's than an image-id filter accepts so match the instances here
+	ec2dii := ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			&ec2.Filter{
+				Name: aws.String("instance-state-name"),
+				Values: []*string{
+					aws.String(ec2.InstanceStateNamePending),
+					aws.String(ec2.InstanceStateNameRunning),
+					aws.String(ec2.InstanceStateNameStopping),
+					aws.String(ec2.InstanceStateNameStopped)}}}}
+
+	err := svc.DescribeInstancesPages(&ec2dii, func(p *ec2.DescribeInstancesOutput, lastPage bool) bool {
+		for _, reservation := range p.Reservations {
+			for _, instance := range reservation.Instances {
+				if imageId := safeString(instance.ImageId); ids[imageId] {
+					inUse[imageId] = append(inUse[imageId], "instance "+*instance.InstanceId)
+				}
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("DescribeInstances: %s", err)
+	}
+
+	// Create an AutoScaling service object in the same region as the AMI's
+	// config values keys & sercet key read from environment
+	assvc := autoscaling.New(session.New(), &aws.Config{MaxRetries: aws.Int(10), Region: svc.Config.Region})
+
+	err = assvc.DescribeLaunchConfigurationsPages(&autoscaling.DescribeLaunchConfigurationsInput{}, func(p *autoscaling.DescribeLaunchConfigurationsOutput, lastPage bool) bool {
+		for _, lc := range p.LaunchConfigurations {
+			if imageId := safeString(lc.ImageId); ids[imageId] {
+				inUse[imageId] = append(inUse[imageId], "launch configuration "+safeString(lc.LaunchConfigurationName))
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("DescribeLaunchConfigurations: %s", err)
+	}
+
+	for _, image := range images {
+
+		ec2diai := ec2.DescribeImageAttributeInput{
+			ImageId:   image.ImageId,
+			Attribute: aws.String(ec2.ImageAttributeNameLaunchPermission)}
+
+		attrResp, err := svc.DescribeImageAttribute(&ec2diai)
+		if err != nil {
+			return nil, fmt.Errorf("DescribeImageAttribute %s: %s", *image.ImageId, err)
+		}
+
+		for _, perm := range attrResp.LaunchPermissions {
+			if safeString(perm.Group) == ec2.PermissionGroupAll {
+				inUse[*image.ImageId] = append(inUse[*image.ImageId], "public launch permission")
+			} else if len(safeString(perm.UserId)) > 0 {
+				inUse[*image.ImageId] = append(inUse[*image.ImageId], "launch permission for account "+*perm.UserId)
+			}
+		}
+	}
+
+	reasons := make(map[string]string)
+	for imageId, uses := range inUse {
+		sort.Strings(uses)
+		reasons[imageId] = "in use by " + strings.Join(uses, ", ")
+	}
+	return reasons, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// journalEntry records one change made to an AWS resource by one of the commands
+type journalEntry struct {
+	Time         time.Time         `json:"time"`
+	Command      string            `json:"command"`
+	Action       string            `json:"action"`
+	ResourceType string            `json:"resource_type"`
+	ResourceId   string            `json:"resource_id"`
+	Region       string            `json:"region,omitempty"`
+	Reason       string            `json:"reason,omitempty"`
+	Details      map[string]string `json:"details,omitempty"`
+	Tags         map[string]string `json:"tags,omitempty"`
+}
+
+// writeJournal appends the entries to the journal file as one json object per line.
+// Nothing is written if no journal file has been provided
+func writeJournal(filename string, entries []*journalEntry) error {
+
+	if len(filename) == 0 || len(entries) == 0 {
+		return nil
+	}
+
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(f)
+	for _, entry := range entries {
+		if err = enc.Encode(entry); err != nil {
+			break
+		}
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// readJournal returns all entries in the journal file in the order they were written
+func readJournal(filename string) ([]*journalEntry, error) {
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []*journalEntry
+	lineNo := 0
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lineNo++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		entry := &journalEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			return nil, fmt.Errorf("%s line %d: %s", filename, lineNo, err)
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, scanner.Err()
+}
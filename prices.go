@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// priceTable holds the on-demand hourly price in USD keyed by region then instance type
+type priceTable map[string]map[string]float64
+
+// bundledPrices holds approximate Linux on-demand hourly prices for common instance types.
+// Use a price file for other regions or types or for accurate figures
+var bundledPrices = priceTable{
+	"us-east-1": {
+		"t2.nano": 0.0058, "t2.micro": 0.0116, "t2.small": 0.023, "t2.medium": 0.0464,
+		"t2.large": 0.0928, "t2.xlarge": 0.1856, "t2.2xlarge": 0.3712,
+		"t3.nano": 0.0052, "t3.micro": 0.0104, "t3.small": 0.0208, "t3.medium": 0.0416,
+		"t3.large": 0.0832, "t3.xlarge": 0.1664, "t3.2xlarge": 0.3328,
+		"m4.large": 0.10, "m4.xlarge": 0.20, "m4.2xlarge": 0.40, "m4.4xlarge": 0.80,
+		"m5.large": 0.096, "m5.xlarge": 0.192, "m5.2xlarge": 0.384, "m5.4xlarge": 0.768,
+		"c4.large": 0.10, "c4.xlarge": 0.199, "c4.2xlarge": 0.398,
+		"c5.large": 0.085, "c5.xlarge": 0.17, "c5.2xlarge": 0.34,
+		"r4.large": 0.133, "r4.xlarge": 0.266, "r4.2xlarge": 0.532,
+		"r5.large": 0.126, "r5.xlarge": 0.252, "r5.2xlarge": 0.504,
+	},
+	"ap-southeast-2": {
+		"t2.nano": 0.0073, "t2.micro": 0.0146, "t2.small": 0.0292, "t2.medium": 0.0584,
+		"t2.large": 0.1168, "t2.xlarge": 0.2336, "t2.2xlarge": 0.4672,
+		"t3.nano": 0.0066, "t3.micro": 0.0132, "t3.small": 0.0264, "t3.medium": 0.0528,
+		"t3.large": 0.1056, "t3.xlarge": 0.2112, "t3.2xlarge": 0.4224,
+		"m4.large": 0.125, "m4.xlarge": 0.25, "m4.2xlarge": 0.50, "m4.4xlarge": 1.00,
+		"m5.large": 0.12, "m5.xlarge": 0.24, "m5.2xlarge": 0.48, "m5.4xlarge": 0.96,
+		"c4.large": 0.13, "c4.xlarge": 0.261, "c4.2xlarge": 0.522,
+		"c5.large": 0.111, "c5.xlarge": 0.222, "c5.2xlarge": 0.444,
+		"r4.large": 0.16, "r4.xlarge": 0.319, "r4.2xlarge": 0.638,
+		"r5.large": 0.151, "r5.xlarge": 0.302, "r5.2xlarge": 0.604,
+	},
+}
+
+// loadPrices returns the bundled price table or, if a file is provided, the prices from
+// that file. Files ending in .csv hold region,instance type,price lines and any other
+// file is read as json in the form {"region": {"instance type": price}}
+func loadPrices(filename string) (priceTable, error) {
+
+	if len(filename) == 0 {
+		return bundledPrices, nil
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	prices := make(priceTable)
+
+	if !strings.EqualFold(filepath.Ext(filename), ".csv") {
+		if err := json.NewDecoder(f).Decode(&prices); err != nil {
+			return nil, fmt.Errorf("%s: %s", filename, err)
+		}
+		return prices, nil
+	}
+
+	r := csv.NewReader(f)
+	r.Comment = '#'
+	r.FieldsPerRecord = 3
+	r.TrimLeadingSpace = true
+
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", filename, err)
+		}
+
+		price, err := strconv.ParseFloat(record[2], 64)
+		if err != nil {
+			// allow a header line
+			if len(prices) == 0 {
+				continue
+			}
+			return nil, fmt.Errorf("%s: invalid price %q for %s %s", filename, record[2], record[0], record[1])
+		}
+
+		if prices[record[0]] == nil {
+			prices[record[0]] = make(map[string]float64)
+		}
+		prices[record[0]][record[1]] = price
+	}
+
+	return prices, nil
+}
+
+// price returns the hourly price for an instance type in a region and if it was found
+func (p priceTable) price(region, instanceType string) (float64, bool) {
+	price, ok := p[region][instanceType]
+	return price, ok
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/rds"
+)
+
+// rdsSnapshotPrefix starts the identifier of every manual DB snapshot made by the snapshot command
+const rdsSnapshotPrefix = "autobkup-"
+
+// createdDBSnapshot tracks a manual DB snapshot until it becomes available
+type createdDBSnapshot struct {
+	snapshotId   string
+	dbInstanceId string
+	status       string
+	tags         []*ec2.Tag
+	drRegion     string
+	drStatus     string
+	encrypted    bool
+}
+
+// snapshotRDS creates a manual snapshot of each DB instance tagged autobkup, or the DB instance
+// provided with -i, tags it so ami-cleanup --rds expires it and copies it to a DR region if asked
+func (c *SSCommand) snapshotRDS(svc *ec2.EC2) int {
+
+	// Create an RDS service object
+	// config values keys, sercet key & region read from environment
+	rdssvc := rds.New(session.New(), &aws.Config{MaxRetries: aws.Int(10)})
+
+	region := safeString(rdssvc.Config.Region)
+	account, err := accountId(svc)
+	if err != nil {
+		fmt.Printf("Fatal error: unable to find the account number - %s\n", err)
+		return RCERR
+	}
+
+	var dbInstances []*rds.DBInstance
+	err = rdssvc.DescribeDBInstancesPages(&rds.DescribeDBInstancesInput{}, func(p *rds.DescribeDBInstancesOutput, lastPage bool) bool {
+		dbInstances = append(dbInstances, p.DBInstances...)
+		return true
+	})
+	if err != nil {
+		fmt.Printf("DescribeDBInstances fatal error: %s\n", err)
+		return RCERR
+	}
+
+	cleanupTag := &ec2.Tag{
+		Key:   aws.String("autocleanup"),
+		Value: aws.String(strconv.FormatInt(time.Now().Unix(), 10))}
+
+	var snapshots []*createdDBSnapshot
+
+	for _, db := range dbInstances {
+
+		dbId := *db.DBInstanceIdentifier
+
+		tagResp, err := rdssvc.ListTagsForResource(&rds.ListTagsForResourceInput{
+			ResourceName: aws.String(rdsArn(region, account, "db", dbId))})
+		if err != nil {
+			fmt.Printf("Error reading tags of DB instance %s. Error details - %s\n", dbId, err)
+			continue
+		}
+		dbTags := ec2Tags(tagResp.TagList)
+
+		if len(c.instanceId) > 0 && c.instanceId != dbId {
+			continue
+		}
+		if _, ok := tagMap(dbTags)["autobkup"]; !ok && len(c.instanceId) == 0 {
+			continue
+		}
+
+		snapshot := &createdDBSnapshot{
+			snapshotId:   rdsSnapshotPrefix + dbId + "-" + time.Now().UTC().Format("20060102-1504"),
+			dbInstanceId: dbId,
+			drRegion:     c.drRegion,
+			encrypted:    aws.BoolValue(db.StorageEncrypted),
+			tags:         append([]*ec2.Tag{cleanupTag}, imageTags(dbId, dbTags, c.copyTags, c.retention)...)}
+		if dr := tagValue(dbTags, "autobkup-dr"); len(dr) > 0 {
+			snapshot.drRegion = dr
+		}
+
+		if c.dryrun {
+			fmt.Printf("Dry Run - Would have created DB snapshot %s of %s\n", snapshot.snapshotId, dbId)
+			if len(snapshot.drRegion) > 0 && snapshot.encrypted {
+				fmt.Printf("Dry Run - Would not have copied the encrypted DB snapshot to DR region %s\n", snapshot.drRegion)
+			} else if len(snapshot.drRegion) > 0 {
+				fmt.Printf("Dry Run - Would have copied the DB snapshot to DR region %s\n", snapshot.drRegion)
+			}
+			continue
+		}
+
+		rdscdsi := rds.CreateDBSnapshotInput{
+			DBInstanceIdentifier: aws.String(dbId),
+			DBSnapshotIdentifier: aws.String(snapshot.snapshotId),
+			Tags:                 rdsTags(snapshot.tags)}
+
+		snapResp, err := rdssvc.CreateDBSnapshot(&rdscdsi)
+		if err != nil {
+			fmt.Printf("Error creating DB snapshot of %s\n", dbId)
+			fmt.Printf("Error details - %s\n", err)
+			continue
+		}
+		snapshot.status = safeString(snapResp.DBSnapshot.Status)
+		snapshots = append(snapshots, snapshot)
+
+		if c.verbose {
+			fmt.Printf("Info - Started creating DB snapshot: %s of %s\n", snapshot.snapshotId, dbId)
+		}
+	}
+
+	if len(snapshots) == 0 {
+		return RCOK
+	}
+
+	if c.verbose {
+		fmt.Printf("DB snapshot creation has started. Now waiting up to %d minutes for the snapshots to become available...\n", c.timeout)
+	}
+	waitForDBSnapshots(rdssvc, snapshots, time.Duration(c.timeout)*time.Minute)
+	copyDBSnapshotsToDR(rdssvc, snapshots, region, account, c.verbose)
+
+	return dbSnapshotReport(snapshots)
+}
+
+// waitForDBSnapshots polls the DB snapshots until they are all available or failed and updates
+// the status of each one. It gives up once the timeout has passed
+func waitForDBSnapshots(rdssvc *rds.RDS, snapshots []*createdDBSnapshot, timeout time.Duration) {
+
+	deadline := time.Now().Add(timeout)
+
+	for {
+		pending := 0
+		for _, snapshot := range snapshots {
+			if snapshot.status != "creating" {
+				continue
+			}
+			resp, err := rdssvc.DescribeDBSnapshots(&rds.DescribeDBSnapshotsInput{
+				DBSnapshotIdentifier: aws.String(snapshot.snapshotId)})
+			if err != nil {
+				fmt.Printf("Warning - unable to check DB snapshot state: %s\n", err)
+				return
+			}
+			if len(resp.DBSnapshots) > 0 {
+				snapshot.status = safeString(resp.DBSnapshots[0].Status)
+			}
+			if snapshot.status == "creating" {
+				pending++
+			}
+		}
+
+		if pending == 0 || time.Now().After(deadline) {
+			return
+		}
+		time.Sleep(30 * time.Second)
+	}
+}
+
+// copyDBSnapshotsToDR copies each available DB snapshot with a DR region into that region with
+// the same tags. The source snapshot is tagged with autobkup-dr-copy so the copy can be found
+func copyDBSnapshotsToDR(rdssvc *rds.RDS, snapshots []*createdDBSnapshot, region string, account string, verbose bool) {
+
+	drsvcs := make(map[string]*rds.RDS)
+
+	for _, snapshot := range snapshots {
+
+		if len(snapshot.drRegion) == 0 || snapshot.drRegion == region {
+			continue
+		}
+		if snapshot.status != "available" {
+			fmt.Printf("Warning - DB snapshot: %s is %s and has not been copied to DR region %s\n", snapshot.snapshotId, snapshot.status, snapshot.drRegion)
+			continue
+		}
+		// this SDK cannot give CopyDBSnapshot the KMS key an encrypted cross region copy needs
+		if snapshot.encrypted {
+			fmt.Printf("Warning - DB snapshot: %s is encrypted and encrypted DB snapshots cannot be copied to DR region %s\n", snapshot.snapshotId, snapshot.drRegion)
+			continue
+		}
+
+		drsvc := drsvcs[snapshot.drRegion]
+		if drsvc == nil {
+			// Create an RDS service object for the DR region
+			// config values keys & sercet key read from environment
+			drsvc = rds.New(session.New(), &aws.Config{MaxRetries: aws.Int(10), Region: aws.String(snapshot.drRegion)})
+			drsvcs[snapshot.drRegion] = drsvc
+		}
+
+		drTags := append(snapshot.tags,
+			&ec2.Tag{Key: aws.String("autobkup-source-snapshot"), Value: aws.String(snapshot.snapshotId)},
+			&ec2.Tag{Key: aws.String("autobkup-source-region"), Value: aws.String(region)})
+
+		// cross region copies must name the source snapshot by its arn
+		copyResp, err := drsvc.CopyDBSnapshot(&rds.CopyDBSnapshotInput{
+			SourceDBSnapshotIdentifier: aws.String(rdsArn(region, account, "snapshot", snapshot.snapshotId)),
+			TargetDBSnapshotIdentifier: aws.String(snapshot.snapshotId),
+			Tags:                       rdsTags(drTags)})
+		if err != nil {
+			fmt.Printf("Error copying DB snapshot: %s to DR region %s. Error details - %s\n", snapshot.snapshotId, snapshot.drRegion, err)
+			continue
+		}
+		snapshot.drStatus = safeString(copyResp.DBSnapshot.Status)
+
+		if verbose {
+			fmt.Printf("Info - Started copying DB snapshot: %s to DR region %s\n", snapshot.snapshotId, snapshot.drRegion)
+		}
+
+		_, err = rdssvc.AddTagsToResource(&rds.AddTagsToResourceInput{
+			ResourceName: aws.String(rdsArn(region, account, "snapshot", snapshot.snapshotId)),
+			Tags: []*rds.Tag{
+				&rds.Tag{
+					Key:   aws.String("autobkup-dr-copy"),
+					Value: aws.String(snapshot.drRegion + "/" + snapshot.snapshotId)}}})
+		if err != nil {
+			fmt.Printf("Warning - problem adding tags to DB snapshot: %s. Error was %s\n", snapshot.snapshotId, err)
+		}
+	}
+}
+
+// dbSnapshotReport displays the DB snapshots that are available, still creating and failed.
+// It returns an error code if any snapshot failed
+func dbSnapshotReport(snapshots []*createdDBSnapshot) int {
+
+	var available, pending, failed []*createdDBSnapshot
+	for _, snapshot := range snapshots {
+		switch snapshot.status {
+		case "available":
+			available = append(available, snapshot)
+		case "creating":
+			pending = append(pending, snapshot)
+		default:
+			failed = append(failed, snapshot)
+		}
+	}
+
+	fmt.Printf("DB snapshot report - available: %d pending: %d failed: %d\n", len(available), len(pending), len(failed))
+	for _, group := range [][]*createdDBSnapshot{available, pending, failed} {
+		for _, snapshot := range group {
+			fmt.Printf("DB snapshot: %s\tDB instance: %s\tState: %s", snapshot.snapshotId, snapshot.dbInstanceId, snapshot.status)
+			if len(snapshot.drStatus) > 0 {
+				fmt.Printf("\tDR copy: %s in %s", snapshot.drStatus, snapshot.drRegion)
+			}
+			fmt.Printf("\n")
+		}
+	}
+
+	if len(failed) > 0 {
+		return RCERR
+	}
+	return RCOK
+}
+
+// cleanupRDS applies the retention policies to the manual DB snapshots made by the snapshot
+// command in this region and in the DR regions they were copied to
+func (c *AMICommand) cleanupRDS(svc *ec2.EC2) int {
+
+	account, err := accountId(svc)
+	if err != nil {
+		fmt.Printf("Fatal error: unable to find the account number - %s\n", err)
+		return RCERR
+	}
+
+	region := safeString(svc.Config.Region)
+	regions := map[string]bool{region: true}
+	for _, dr := range splitIds(c.drRegions) {
+		regions[*dr] = true
+	}
+
+	rc := RCOK
+	done := make(map[string]bool)
+
+	// DR regions are found while cleaning up so keep going until every region is done
+	for len(done) < len(regions) {
+		for _, r := range sortedIds(regions) {
+			if done[r] {
+				continue
+			}
+			done[r] = true
+
+			// Create an RDS service object for the region
+			// config values keys & sercet key read from environment
+			rdssvc := rds.New(session.New(), &aws.Config{MaxRetries: aws.Int(10), Region: aws.String(r)})
+
+			found, regionRc := c.cleanupDBSnapshots(rdssvc, r, account)
+			if regionRc != RCOK {
+				rc = regionRc
+			}
+			for _, dr := range found {
+				regions[dr] = true
+			}
+		}
+	}
+	return rc
+}
+
+// cleanupDBSnapshots deletes the manual DB snapshots in one region that the retention policy does
+// not keep. It returns the DR regions named in the autobkup-dr-copy tags of the snapshots
+func (c *AMICommand) cleanupDBSnapshots(rdssvc *rds.RDS, region string, account string) (drRegions []string, rc int) {
+
+	if c.verbose {
+		fmt.Printf("Info - Cleaning up DB snapshots in region: %s\n", region)
+	}
+
+	var candidates []*retainedBackup
+
+	err := rdssvc.DescribeDBSnapshotsPages(&rds.DescribeDBSnapshotsInput{SnapshotType: aws.String("manual")}, func(p *rds.DescribeDBSnapshotsOutput, lastPage bool) bool {
+		for _, snapshot := range p.DBSnapshots {
+			if !strings.HasPrefix(safeString(snapshot.DBSnapshotIdentifier), rdsSnapshotPrefix) || safeString(snapshot.Status) != "available" {
+				continue
+			}
+			candidates = append(candidates, &retainedBackup{
+				id:    *snapshot.DBSnapshotIdentifier,
+				group: safeString(snapshot.DBInstanceIdentifier)})
+			if snapshot.SnapshotCreateTime != nil {
+				candidates[len(candidates)-1].created = *snapshot.SnapshotCreateTime
+			}
+		}
+		return true
+	})
+	if err != nil {
+		fmt.Printf("DescribeDBSnapshots fatal error: %s\n", err)
+		return nil, RCERR
+	}
+
+	// only snapshots tagged by the snapshot command are cleaned up
+	var backups []*retainedBackup
+	for _, backup := range candidates {
+		tagResp, err := rdssvc.ListTagsForResource(&rds.ListTagsForResourceInput{
+			ResourceName: aws.String(rdsArn(region, account, "snapshot", backup.id))})
+		if err != nil {
+			fmt.Printf("Error reading tags of DB snapshot %s. Error details - %s\n", backup.id, err)
+			rc = RCERR
+			continue
+		}
+		backup.tags = ec2Tags(tagResp.TagList)
+
+		if len(tagValue(backup.tags, "autobkup-created-by")) == 0 {
+			continue
+		}
+		if epoch, err := strconv.ParseInt(tagValue(backup.tags, "autocleanup"), 10, 64); err == nil {
+			backup.created = time.Unix(epoch, 0)
+		}
+		if dr := tagValue(backup.tags, "autobkup-dr-copy"); len(dr) > 0 {
+			drRegions = append(drRegions, strings.SplitN(dr, "/", 2)[0])
+		}
+		backups = append(backups, backup)
+	}
+
+	decisions := retentionDecisions(backups, c.policyBook, c.autoDays, c.keep, time.Now())
+	for _, backup := range decisions {
+
+		switch {
+		case backup.keep && c.dryrun:
+			fmt.Printf("Dry Run - Would have kept DB snapshot: %s reason: %s\n", backup.id, backup.reason)
+		case backup.keep:
+			if c.verbose {
+				fmt.Printf("Info - Not deleting DB snapshot: %s reason: %s\n", backup.id, backup.reason)
+			}
+		case c.dryrun:
+			fmt.Printf("Dry Run - Would have deleted DB snapshot: %s reason: %s\n", backup.id, backup.reason)
+		default:
+			if c.verbose {
+				fmt.Printf("Info - Deleting DB snapshot: %s reason: %s\n", backup.id, backup.reason)
+			}
+			if _, err := rdssvc.DeleteDBSnapshot(&rds.DeleteDBSnapshotInput{DBSnapshotIdentifier: aws.String(backup.id)}); err != nil {
+				fmt.Printf("error deleting DB snapshot %s. Error details - %s\n", backup.id, err)
+				rc = RCERR
+			}
+		}
+	}
+
+	return drRegions, rc
+}
+
+// rdsArn returns the arn of an RDS resource such as a db or snapshot
+func rdsArn(region, account, resourceType, id string) string {
+	return fmt.Sprintf("arn:aws:rds:%s:%s:%s:%s", region, account, resourceType, id)
+}
+
+// ec2Tags converts RDS tags to EC2 tags so the shared tag helpers can be used
+func ec2Tags(tags []*rds.Tag) []*ec2.Tag {
+	converted := make([]*ec2.Tag, 0, len(tags))
+	for _, tag := range tags {
+		converted = append(converted, &ec2.Tag{Key: tag.Key, Value: tag.Value})
+	}
+	return converted
+}
+
+// rdsTags converts EC2 tags to RDS tags
+func rdsTags(tags []*ec2.Tag) []*rds.Tag {
+	converted := make([]*rds.Tag, 0, len(tags))
+	for _, tag := range tags {
+		converted = append(converted, &rds.Tag{Key: tag.Key, Value: tag.Value})
+	}
+	return converted
+}
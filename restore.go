@@ -0,0 +1,440 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/mitchellh/cli"
+)
+
+type RestoreCommand struct {
+	dryrun         bool
+	verbose        bool
+	instanceId     string
+	at             string
+	amiId          string
+	instanceType   string
+	subnetId       string
+	securityGroups string
+	iamProfile     string
+	keyName        string
+	snapshotId     string
+	az             string
+	attach         string
+	device         string
+	volumeType     string
+	timeout        int
+	Ui             cli.Ui
+}
+
+// Help function displays detailed help for the restore sub command
+func (c *RestoreCommand) Help() string {
+	return `
+	Description:
+	Restore from backups made by snapshot.
+
+	Instance mode launches a replacement for an instance from the newest AMI
+	created from it at or before a point in time. AMI's are matched by their
+	autobkup-source-instance tag or by the description snapshot gives them.
+	The instance type, subnet, security groups, IAM profile, key pair and tags
+	are copied from the original instance. If the original no longer exists
+	the AMI tags are used and the other settings must be given as flags.
+
+	Volume mode creates a volume from a snapshot and optionally attaches it to
+	an instance. The availability zone defaults to the zone of that instance.
+
+	Usage:
+		awsgo-tools restore --instance <id> [flags]
+		awsgo-tools restore --snapshot <id> [flags]
+
+	Flags:
+	--instance <id> - source instance to restore
+	--at <time> - point in time such as 2026-10-18T09:00. default now
+	--ami <id> - restore from this AMI instead of searching
+	--instance-type <type> - override the instance type
+	--subnet <id> - override the subnet
+	--security-groups <ids> - override the comma separated security groups
+	--iam-profile <arn> - override the IAM instance profile
+	--key <name> - override the key pair
+	--snapshot <id> - snapshot to create a volume from
+	--az <zone> - availability zone for the volume
+	--attach <instance id> - attach the volume to this instance
+	--device <name> - device name to attach as. default /dev/sdf
+	--volume-type <type> - volume type such as gp2. default standard
+	-t <minutes> - time to wait for the volume to become available. default 10
+	-n - Dry Run. Report what would have been done but make no changes
+	-v - produce verbose output
+	`
+}
+
+// Synopsis function returns a string with concise details of the sub command
+func (c *RestoreCommand) Synopsis() string {
+	return "Restore instances or volumes from backups"
+}
+
+// Run function is the function called by the cli library to run the actual sub command code.
+func (c *RestoreCommand) Run(args []string) int {
+
+	cmdFlags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+
+	cmdFlags.StringVar(&c.instanceId, "instance", "", "Source instance to restore")
+	cmdFlags.StringVar(&c.at, "at", "", "Point in time to restore")
+	cmdFlags.StringVar(&c.amiId, "ami", "", "AMI to restore from")
+	cmdFlags.StringVar(&c.instanceType, "instance-type", "", "Instance type")
+	cmdFlags.StringVar(&c.subnetId, "subnet", "", "Subnet")
+	cmdFlags.StringVar(&c.securityGroups, "security-groups", "", "Security groups")
+	cmdFlags.StringVar(&c.iamProfile, "iam-profile", "", "IAM instance profile arn")
+	cmdFlags.StringVar(&c.keyName, "key", "", "Key pair")
+	cmdFlags.StringVar(&c.snapshotId, "snapshot", "", "Snapshot to restore")
+	cmdFlags.StringVar(&c.az, "az", "", "Availability zone for the volume")
+	cmdFlags.StringVar(&c.attach, "attach", "", "Instance to attach the volume to")
+	cmdFlags.StringVar(&c.device, "device", "/dev/sdf", "Device name to attach as")
+	cmdFlags.StringVar(&c.volumeType, "volume-type", "", "Volume type")
+	cmdFlags.IntVar(&c.timeout, "t", 10, "Minutes to wait for the volume")
+	cmdFlags.BoolVar(&c.dryrun, "n", false, "Dry Run")
+	cmdFlags.BoolVar(&c.verbose, "v", false, "Produce verbose output")
+	if err := cmdFlags.Parse(args); err != nil {
+		return RCERR
+	}
+
+	if len(c.instanceId) == 0 && len(c.amiId) == 0 && len(c.snapshotId) == 0 {
+		fmt.Printf("Nothing to restore. Please provide an instance id, an AMI or a snapshot\n")
+		return RCERR
+	}
+
+	// Create an EC2 service object
+	// config values keys, sercet key & region read from environment
+	svc := ec2.New(session.New(), &aws.Config{MaxRetries: aws.Int(10)})
+
+	if len(c.snapshotId) > 0 {
+		return c.restoreVolume(svc)
+	}
+	return c.restoreInstance(svc)
+}
+
+// restoreInstance launches a replacement for the source instance from its backup AMI
+func (c *RestoreCommand) restoreInstance(svc *ec2.EC2) int {
+
+	at := time.Now()
+	if len(c.at) > 0 {
+		var err error
+		if at, err = parseSkipUntil(c.at, time.Local); err != nil {
+			fmt.Printf("Invalid point in time %s. Expected 2006-01-02T15:04 or RFC3339\n", c.at)
+			return RCERR
+		}
+	}
+
+	image, err := findBackupImage(svc, c.instanceId, c.amiId, at)
+	if err != nil {
+		fmt.Printf("Fatal error: %s\n", err)
+		return RCERR
+	}
+
+	sourceId := c.instanceId
+	if len(sourceId) == 0 {
+		sourceId = imageGroup(image)
+	}
+
+	// the original may have been terminated so fall back to the AMI tags and the flags
+	var original *ec2.Instance
+	ec2dii := ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			&ec2.Filter{
+				Name:   aws.String("instance-id"),
+				Values: []*string{aws.String(sourceId)}}}}
+
+	resp, err := svc.DescribeInstances(&ec2dii)
+	if err != nil {
+		fmt.Printf("DescribeInstances fatal error: %s\n", err)
+		return RCERR
+	}
+	for _, reservation := range resp.Reservations {
+		for _, instance := range reservation.Instances {
+			original = instance
+		}
+	}
+
+	ec2rii := ec2.RunInstancesInput{
+		ImageId:  image.ImageId,
+		MinCount: aws.Int64(1),
+		MaxCount: aws.Int64(1)}
+
+	tags := image.Tags
+
+	if original != nil {
+		ec2rii.InstanceType = original.InstanceType
+		ec2rii.SubnetId = original.SubnetId
+		ec2rii.KeyName = original.KeyName
+		for _, group := range original.SecurityGroups {
+			ec2rii.SecurityGroupIds = append(ec2rii.SecurityGroupIds, group.GroupId)
+		}
+		if original.IamInstanceProfile != nil {
+			ec2rii.IamInstanceProfile = &ec2.IamInstanceProfileSpecification{Arn: original.IamInstanceProfile.Arn}
+		}
+		tags = original.Tags
+	} else if c.verbose {
+		fmt.Printf("Info - Original instance %s not found. Using the AMI tags and flags\n", sourceId)
+	}
+
+	if len(c.instanceType) > 0 {
+		ec2rii.InstanceType = aws.String(c.instanceType)
+	}
+	if len(c.subnetId) > 0 {
+		ec2rii.SubnetId = aws.String(c.subnetId)
+	}
+	if len(c.securityGroups) > 0 {
+		ec2rii.SecurityGroupIds = splitIds(c.securityGroups)
+	}
+	if len(c.iamProfile) > 0 {
+		ec2rii.IamInstanceProfile = &ec2.IamInstanceProfileSpecification{Arn: aws.String(c.iamProfile)}
+	}
+	if len(c.keyName) > 0 {
+		ec2rii.KeyName = aws.String(c.keyName)
+	}
+
+	if ec2rii.InstanceType == nil {
+		fmt.Printf("Original instance %s not found. Please provide --instance-type\n", sourceId)
+		return RCERR
+	}
+
+	restoredTags := append(restorableTags(tags),
+		&ec2.Tag{Key: aws.String("autobkup-restored-from"), Value: image.ImageId},
+		&ec2.Tag{Key: aws.String("autobkup-restored-instance"), Value: aws.String(sourceId)})
+
+	var groups []string
+	for _, group := range ec2rii.SecurityGroupIds {
+		groups = append(groups, *group)
+	}
+	profile := ""
+	if ec2rii.IamInstanceProfile != nil {
+		profile = safeString(ec2rii.IamInstanceProfile.Arn)
+	}
+
+	if c.dryrun || c.verbose {
+		prefix := "Info - Launching"
+		if c.dryrun {
+			prefix = "Dry Run - Would have launched"
+		}
+		fmt.Printf("%s instance from AMI %s created %s\n", prefix, *image.ImageId, imageCreated(image).Format(time.RFC3339))
+		fmt.Printf("\tType: %s Subnet: %s Security groups: %s IAM profile: %s Key: %s\n",
+			safeString(ec2rii.InstanceType), safeString(ec2rii.SubnetId), strings.Join(groups, ","),
+			profile, safeString(ec2rii.KeyName))
+		fmt.Printf("\tTags: %s\n", formatTags(restoredTags))
+	}
+	if c.dryrun {
+		return RCOK
+	}
+
+	runResp, err := svc.RunInstances(&ec2rii)
+	if err != nil {
+		fmt.Printf("RunInstances fatal error: %s\n", err)
+		return RCERR
+	}
+
+	newId := runResp.Instances[0].InstanceId
+
+	ec2cti := ec2.CreateTagsInput{
+		Resources: []*string{newId},
+		Tags:      restoredTags}
+
+	if _, err = svc.CreateTags(&ec2cti); err != nil {
+		fmt.Printf("Warning - problem adding tags to instance: %s. Error was %s\n", *newId, err)
+	}
+
+	fmt.Printf("Restored instance %s as %s from AMI %s\n", sourceId, *newId, *image.ImageId)
+	return RCOK
+}
+
+// restoreVolume creates a volume from the snapshot and attaches it if requested
+func (c *RestoreCommand) restoreVolume(svc *ec2.EC2) int {
+
+	snapResp, err := svc.DescribeSnapshots(&ec2.DescribeSnapshotsInput{SnapshotIds: []*string{aws.String(c.snapshotId)}})
+	if err != nil {
+		fmt.Printf("DescribeSnapshots fatal error: %s\n", err)
+		return RCERR
+	}
+	if len(snapResp.Snapshots) == 0 {
+		fmt.Printf("Snapshot %s not found\n", c.snapshotId)
+		return RCERR
+	}
+	snapshot := snapResp.Snapshots[0]
+
+	// default to the zone of the instance the volume is attached to
+	if len(c.az) == 0 && len(c.attach) > 0 {
+		resp, err := svc.DescribeInstances(&ec2.DescribeInstancesInput{InstanceIds: []*string{aws.String(c.attach)}})
+		if err != nil {
+			fmt.Printf("DescribeInstances fatal error: %s\n", err)
+			return RCERR
+		}
+		for _, reservation := range resp.Reservations {
+			for _, instance := range reservation.Instances {
+				if instance.Placement != nil {
+					c.az = safeString(instance.Placement.AvailabilityZone)
+				}
+			}
+		}
+	}
+
+	if len(c.az) == 0 {
+		fmt.Printf("No availability zone provided. Please provide --az or an instance to attach to\n")
+		return RCERR
+	}
+
+	ec2cvi := ec2.CreateVolumeInput{
+		SnapshotId:       snapshot.SnapshotId,
+		AvailabilityZone: aws.String(c.az)}
+	if len(c.volumeType) > 0 {
+		ec2cvi.VolumeType = aws.String(c.volumeType)
+	}
+
+	restoredTags := append(restorableTags(snapshot.Tags),
+		&ec2.Tag{Key: aws.String("autobkup-restored-from"), Value: snapshot.SnapshotId})
+
+	if c.dryrun {
+		fmt.Printf("Dry Run - Would have created volume from snapshot %s in %s\n", c.snapshotId, c.az)
+		fmt.Printf("\tTags: %s\n", formatTags(restoredTags))
+		if len(c.attach) > 0 {
+			fmt.Printf("Dry Run - Would have attached the volume to instance %s as %s\n", c.attach, c.device)
+		}
+		return RCOK
+	}
+
+	volume, err := svc.CreateVolume(&ec2cvi)
+	if err != nil {
+		fmt.Printf("CreateVolume fatal error: %s\n", err)
+		return RCERR
+	}
+	fmt.Printf("Created volume %s from snapshot %s in %s\n", *volume.VolumeId, c.snapshotId, c.az)
+
+	ec2cti := ec2.CreateTagsInput{
+		Resources: []*string{volume.VolumeId},
+		Tags:      restoredTags}
+
+	if _, err = svc.CreateTags(&ec2cti); err != nil {
+		fmt.Printf("Warning - problem adding tags to volume: %s. Error was %s\n", *volume.VolumeId, err)
+	}
+
+	if len(c.attach) == 0 {
+		return RCOK
+	}
+
+	if c.verbose {
+		fmt.Printf("Info - Waiting up to %d minutes for volume %s to become available\n", c.timeout, *volume.VolumeId)
+	}
+
+	err = waitTimeout(time.Duration(c.timeout)*time.Minute, func() error {
+		return svc.WaitUntilVolumeAvailable(&ec2.DescribeVolumesInput{VolumeIds: []*string{volume.VolumeId}})
+	})
+	if err != nil {
+		fmt.Printf("Volume %s did not become available: %s\n", *volume.VolumeId, err)
+		return RCERR
+	}
+
+	ec2avi := ec2.AttachVolumeInput{
+		VolumeId:   volume.VolumeId,
+		InstanceId: aws.String(c.attach),
+		Device:     aws.String(c.device)}
+
+	if _, err = svc.AttachVolume(&ec2avi); err != nil {
+		fmt.Printf("AttachVolume fatal error: %s\n", err)
+		return RCERR
+	}
+
+	fmt.Printf("Attached volume %s to instance %s as %s\n", *volume.VolumeId, c.attach, c.device)
+	return RCOK
+}
+
+// findBackupImage returns the AMI provided or the newest available AMI created from the
+// source instance at or before the time provided
+func findBackupImage(svc *ec2.EC2, instanceId string, amiId string, at time.Time) (*ec2.Image, error) {
+
+	if len(amiId) > 0 {
+		resp, err := svc.DescribeImages(&ec2.DescribeImagesInput{ImageIds: []*string{aws.String(amiId)}})
+		if err != nil {
+			return nil, err
+		}
+		if len(resp.Images) == 0 {
+			return nil, fmt.Errorf("AMI %s not found", amiId)
+		}
+		return resp.Images[0], nil
+	}
+
+	var images []*ec2.Image
+
+	// AMI's made before provenance tags were added only have the description
+	for _, filter := range []*ec2.Filter{
+		&ec2.Filter{
+			Name:   aws.String("tag:autobkup-source-instance"),
+			Values: []*string{aws.String(instanceId)}},
+		&ec2.Filter{
+			Name:   aws.String("description"),
+			Values: []*string{aws.String("Auto backup of instance " + instanceId)}}} {
+
+		resp, err := svc.DescribeImages(&ec2.DescribeImagesInput{
+			Owners: []*string{aws.String("self")},
+			Filters: []*ec2.Filter{
+				filter,
+				&ec2.Filter{
+					Name:   aws.String("state"),
+					Values: []*string{aws.String(ec2.ImageStateAvailable)}}}})
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, resp.Images...)
+	}
+
+	sort.Slice(images, func(i, j int) bool { return imageCreated(images[i]).After(imageCreated(images[j])) })
+
+	for _, image := range images {
+		if !imageCreated(image).After(at) {
+			return image, nil
+		}
+	}
+	return nil, fmt.Errorf("no available AMI of instance %s created at or before %s", instanceId, at.Format(time.RFC3339))
+}
+
+// provenanceTags are the tags that describe a backup, or its cleanup state, rather than the
+// resource it was taken of
+var provenanceTags = map[string]bool{
+	"autobkup-created-by":  true,
+	"autobkup-device":      true,
+	"autobkup-dr-copy":     true,
+	"autobkup-verified":    true,
+	"autobkup-verified-at": true,
+	"autobkup-verify":      true,
+	pendingDeleteTag:       true,
+	pendingPermissionsTag:  true,
+	exemptTag:              true,
+	encryptedFromTag:       true,
+}
+
+// restorableTags returns the tags to put on a restored resource. Reserved aws: tags are
+// dropped along with the provenance and cleanup tags so the restored copy is not mistaken for
+// a backup. Backup settings such as autobkup are kept so the restored copy is still backed up
+func restorableTags(tags []*ec2.Tag) (restored []*ec2.Tag) {
+	for _, tag := range tags {
+		key := safeString(tag.Key)
+		if strings.HasPrefix(key, "aws:") || strings.HasPrefix(key, "autobkup-source-") ||
+			strings.HasPrefix(key, "autobkup-restored-") || provenanceTags[key] || strings.HasPrefix(key, "autocleanup") {
+			continue
+		}
+		restored = append(restored, &ec2.Tag{Key: tag.Key, Value: tag.Value})
+	}
+	return restored
+}
+
+// formatTags returns the tags as key=value pairs for display
+func formatTags(tags []*ec2.Tag) string {
+	var pairs []string
+	for _, tag := range tags {
+		pairs = append(pairs, safeString(tag.Key)+"="+safeString(tag.Value))
+	}
+	return strings.Join(pairs, " ")
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// retentionPolicy decides which AMI's of one source instance are kept. An AMI is kept if any
+// rule keeps it. The daily, weekly and monthly rules keep the newest AMI in each of that many
+// most recent days, weeks or months that have an AMI
+type retentionPolicy struct {
+	days    int // keep AMI's younger than this many days
+	daily   int
+	weekly  int
+	monthly int
+	newest  int // always keep this many of the newest AMI's
+}
+
+// policyBook holds named retention policies keyed by name
+type policyBook map[string]*retentionPolicy
+
+// retainedBackup records the retention decision for one AMI or snapshot and why
+type retainedBackup struct {
+	id      string
+	image   *ec2.Image
+	tags    []*ec2.Tag
+	created time.Time
+	group   string
+	keep    bool
+	reason  string
+}
+
+// parsePolicy reads a retention policy in the form daily=7;weekly=4;monthly=12;newest=2
+// with days=<n> for a flat maximum age
+func parsePolicy(value string) (*retentionPolicy, error) {
+
+	p := &retentionPolicy{}
+
+	for _, field := range strings.Split(value, ";") {
+		field = strings.TrimSpace(field)
+		if len(field) == 0 {
+			continue
+		}
+
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid policy field %q. Expected key=count", field)
+		}
+
+		count, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || count < 0 {
+			return nil, fmt.Errorf("invalid count %q for %s", parts[1], parts[0])
+		}
+
+		switch strings.ToLower(strings.TrimSpace(parts[0])) {
+		case "days":
+			p.days = count
+		case "daily":
+			p.daily = count
+		case "weekly":
+			p.weekly = count
+		case "monthly":
+			p.monthly = count
+		case "newest":
+			p.newest = count
+		default:
+			return nil, fmt.Errorf("unknown policy field %q", parts[0])
+		}
+	}
+
+	if *p == (retentionPolicy{}) {
+		return nil, fmt.Errorf("policy %q keeps nothing", value)
+	}
+	return p, nil
+}
+
+// String returns the policy in the form read by parsePolicy
+func (p *retentionPolicy) String() string {
+	var fields []string
+	for _, f := range []struct {
+		name  string
+		count int
+	}{{"days", p.days}, {"daily", p.daily}, {"weekly", p.weekly}, {"monthly", p.monthly}, {"newest", p.newest}} {
+		if f.count > 0 {
+			fields = append(fields, fmt.Sprintf("%s=%d", f.name, f.count))
+		}
+	}
+	return strings.Join(fields, ";")
+}
+
+// loadPolicies reads a policy file with one named policy per line in the form
+// name: daily=7;weekly=4;monthly=12;newest=2. Blank lines and lines starting with # are ignored.
+// A policy named default applies to AMI's without a policy of their own
+func loadPolicies(filename string) (policyBook, error) {
+
+	policies := make(policyBook)
+
+	if len(filename) == 0 {
+		return policies, nil
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	lineNo := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s line %d: expected name: policy", filename, lineNo)
+		}
+
+		p, err := parsePolicy(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %s", filename, lineNo, err)
+		}
+		policies[strings.TrimSpace(parts[0])] = p
+	}
+
+	return policies, scanner.Err()
+}
+
+// policyFor returns the retention policy of a backup from its tags. An autocleanup-policy tag holds
+// either a policy or the name of one in the policy file. Otherwise the policy named in the
+// autobkup-retention tag, the default policy or a flat age of autoDays keeping the newest keep
+// backups is used in that order
+func policyFor(tags []*ec2.Tag, policies policyBook, autoDays int, keep int) (*retentionPolicy, string, error) {
+
+	if value := tagValue(tags, "autocleanup-policy"); len(value) > 0 {
+		if strings.Contains(value, "=") {
+			p, err := parsePolicy(value)
+			return p, "autocleanup-policy tag", err
+		}
+		if p := policies[value]; p != nil {
+			return p, "policy " + value, nil
+		}
+		return nil, "", fmt.Errorf("autocleanup-policy %q not found in policy file", value)
+	}
+
+	if name := tagValue(tags, "autobkup-retention"); len(name) > 0 && policies[name] != nil {
+		return policies[name], "policy " + name, nil
+	}
+
+	if p := policies["default"]; p != nil {
+		return p, "policy default", nil
+	}
+
+	if autoDays > 0 || keep > 0 {
+		return &retentionPolicy{days: autoDays, newest: keep}, "flags", nil
+	}
+	return nil, "", nil
+}
+
+// retainedImages returns the AMI's ready for retentionDecisions grouped by source instance
+func retainedImages(images []*ec2.Image) []*retainedBackup {
+	var backups []*retainedBackup
+	for _, image := range images {
+		backups = append(backups, &retainedBackup{
+			id:      *image.ImageId,
+			image:   image,
+			tags:    image.Tags,
+			created: imageCreated(image),
+			group:   imageGroup(image)})
+	}
+	return backups
+}
+
+// retentionDecisions applies the retention policy of the newest backup in each group
+// to every backup in the group and returns the backups sorted by group, newest first
+func retentionDecisions(decisions []*retainedBackup, policies policyBook, autoDays int, keep int, now time.Time) []*retainedBackup {
+
+	groups := make(map[string][]*retainedBackup)
+	for _, ri := range decisions {
+		groups[ri.group] = append(groups[ri.group], ri)
+	}
+
+	for _, group := range groups {
+
+		sort.SliceStable(group, func(i, j int) bool { return group[i].created.After(group[j].created) })
+
+		p, source, err := policyFor(group[0].tags, policies, autoDays, keep)
+		switch {
+		case err != nil:
+			for _, ri := range group {
+				ri.keep, ri.reason = true, "invalid retention policy: "+err.Error()
+			}
+		case p == nil:
+			for _, ri := range group {
+				ri.keep, ri.reason = true, "no retention policy"
+			}
+		default:
+			p.apply(group, now, source)
+		}
+	}
+
+	sort.SliceStable(decisions, func(i, j int) bool {
+		if decisions[i].group != decisions[j].group {
+			return decisions[i].group < decisions[j].group
+		}
+		return decisions[i].created.After(decisions[j].created)
+	})
+	return decisions
+}
+
+// apply marks the backups of one group, sorted newest first, as kept or deleted with the reason
+func (p *retentionPolicy) apply(group []*retainedBackup, now time.Time, source string) {
+
+	reasons := make([][]string, len(group))
+
+	for i, ri := range group {
+		if i < p.newest {
+			reasons[i] = append(reasons[i], fmt.Sprintf("newest %d", p.newest))
+		}
+		if age := now.Sub(ri.created); p.days > 0 && age < time.Duration(p.days)*24*time.Hour {
+			reasons[i] = append(reasons[i], fmt.Sprintf("age %.1f days under %d days", age.Hours()/24, p.days))
+		}
+	}
+
+	// keep the newest AMI in each of the most recent periods that have an AMI
+	for _, rule := range []struct {
+		name   string
+		count  int
+		period func(time.Time) string
+	}{
+		{"daily", p.daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{"weekly", p.weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{"monthly", p.monthly, func(t time.Time) string { return t.Format("2006-01") }},
+	} {
+		seen := make(map[string]bool)
+		for i, ri := range group {
+			if len(seen) >= rule.count {
+				break
+			}
+			if period := rule.period(ri.created.UTC()); !seen[period] {
+				seen[period] = true
+				reasons[i] = append(reasons[i], rule.name+" "+period)
+			}
+		}
+	}
+
+	for i, ri := range group {
+		if len(reasons[i]) > 0 {
+			ri.keep = true
+			ri.reason = fmt.Sprintf("kept by %s (%s) %s", source, p, strings.Join(reasons[i], ", "))
+		} else {
+			ri.reason = fmt.Sprintf("not kept by %s (%s)", source, p)
+		}
+	}
+}
+
+// imageCreated returns the time in the autocleanup tag of an AMI, or its creation date
+// if the tag is not a valid time
+func imageCreated(image *ec2.Image) time.Time {
+	if epoch, err := strconv.ParseInt(tagValue(image.Tags, "autocleanup"), 10, 64); err == nil {
+		return time.Unix(epoch, 0)
+	}
+	created, _ := time.Parse(time.RFC3339, safeString(image.CreationDate))
+	return created
+}
+
+// imageGroup returns the source instance of an AMI from its provenance tag or from the
+// description snapshot gives its AMI's. AMI's with neither are in a group of their own
+func imageGroup(image *ec2.Image) string {
+	if instanceId := tagValue(image.Tags, "autobkup-source-instance"); len(instanceId) > 0 {
+		return instanceId
+	}
+	if description := safeString(image.Description); strings.HasPrefix(description, "Auto backup of instance ") {
+		return strings.TrimPrefix(description, "Auto backup of instance ")
+	}
+	return *image.ImageId
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/mitchellh/cli"
+)
+
+type SavingsCommand struct {
+	csv     bool
+	journal string
+	prices  string
+	tagKey  string
+	since   string
+	Ui      cli.Ui
+}
+
+// stoppedInstance tracks the journal history of one instance while working out its stopped hours
+type stoppedInstance struct {
+	id           string
+	region       string
+	instanceType string
+	tags         map[string]string
+	stoppedAt    time.Time
+}
+
+// savingsTotal holds the stopped hours and the estimated savings for one line of the report
+type savingsTotal struct {
+	hours   float64
+	savings float64
+}
+
+// Help function displays detailed help for the savings sub command
+func (c *SavingsCommand) Help() string {
+	return `
+	Description:
+	Estimate the savings made by autostop from the hours each instance spent stopped.
+	Stopped hours come from the autostop and autostart journal. An instance started
+	by hand is picked up from its launch time the next time autostop stops it, and an
+	instance still stopped at the end of the journal is checked with EC2.
+	Hours are priced at the on-demand rate of the instance type in its region using
+	either the bundled approximate Linux prices or a price file.
+
+	Usage:
+		awsgo-tools savings --journal <file> [flags]
+
+	Flags:
+	--journal <file> - journal file written by autostop and autostart
+	--prices <file> - price file. json {"region": {"type": price}} or csv region,type,price
+	--tag-key <key> - tag key to total savings by. default Environment
+	--since <YYYY-MM-DD> - only count stopped hours from this date
+	-c - produce output in csv format
+	`
+}
+
+// Synopsis function returns a string with concise details of the sub command
+func (c *SavingsCommand) Synopsis() string {
+	return "Autostop savings report"
+}
+
+// Run function is the function called by the cli library to run the actual sub command code.
+func (c *SavingsCommand) Run(args []string) int {
+
+	cmdFlags := flag.NewFlagSet("savings", flag.ContinueOnError)
+	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+
+	cmdFlags.StringVar(&c.journal, "journal", "", "Journal file written by autostop")
+	cmdFlags.StringVar(&c.prices, "prices", "", "Price file")
+	cmdFlags.StringVar(&c.tagKey, "tag-key", "Environment", "Tag key to total savings by")
+	cmdFlags.StringVar(&c.since, "since", "", "Only count stopped hours from this date")
+	cmdFlags.BoolVar(&c.csv, "c", false, "Produce output in csv format")
+	if err := cmdFlags.Parse(args); err != nil {
+		return RCERR
+	}
+
+	if len(c.journal) == 0 {
+		fmt.Printf("No journal file provided. Please provide the journal file written by autostop\n")
+		return RCERR
+	}
+
+	var since time.Time
+	if len(c.since) > 0 {
+		var err error
+		if since, err = time.Parse("2006-01-02", c.since); err != nil {
+			fmt.Printf("Invalid since date %s. Expected YYYY-MM-DD\n", c.since)
+			return RCERR
+		}
+	}
+
+	prices, err := loadPrices(c.prices)
+	if err != nil {
+		fmt.Printf("Fatal error: unable to load prices - %s\n", err)
+		return RCERR
+	}
+
+	entries, err := readJournal(c.journal)
+	if err != nil {
+		fmt.Printf("Fatal error: unable to read journal - %s\n", err)
+		return RCERR
+	}
+
+	now := time.Now().UTC()
+
+	perInstance := make(map[string]*savingsTotal)
+	perTag := make(map[string]*savingsTotal)
+	perMonth := make(map[string]*savingsTotal)
+	var total savingsTotal
+
+	instances := make(map[string]*stoppedInstance)
+	missingPrice := make(map[string]bool)
+
+	// addStopped prices the hours between from and to and adds them to each total
+	addStopped := func(si *stoppedInstance, from, to time.Time) {
+
+		if from.Before(since) {
+			from = since
+		}
+		if !to.After(from) {
+			return
+		}
+
+		price, ok := prices.price(si.region, si.instanceType)
+		if !ok && !missingPrice[si.region+" "+si.instanceType] {
+			missingPrice[si.region+" "+si.instanceType] = true
+			fmt.Printf("Warning - no price found for %s in %s. Savings for these hours are shown as 0\n",
+				si.instanceType, si.region)
+		}
+
+		tag := si.tags[c.tagKey]
+		if len(tag) == 0 {
+			tag = "(none)"
+		}
+
+		// split the hours across calendar months
+		for from.Before(to) {
+			monthEnd := time.Date(from.Year(), from.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			if monthEnd.After(to) {
+				monthEnd = to
+			}
+
+			hours := monthEnd.Sub(from).Hours()
+			for _, t := range []*savingsTotal{
+				savingsLine(perInstance, si.id),
+				savingsLine(perTag, tag),
+				savingsLine(perMonth, from.Format("2006-01")),
+				&total} {
+				t.hours += hours
+				t.savings += hours * price
+			}
+			from = monthEnd
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time.Before(entries[j].Time) })
+
+	for _, entry := range entries {
+
+		if entry.ResourceType != "instance" {
+			continue
+		}
+
+		si := instances[entry.ResourceId]
+		if si == nil {
+			si = &stoppedInstance{id: entry.ResourceId}
+			instances[entry.ResourceId] = si
+		}
+		si.region = entry.Region
+		si.instanceType = entry.Details["instance_type"]
+		si.tags = entry.Tags
+
+		switch entry.Action {
+		case actionStop:
+			// a second stop means the instance was started by hand in between
+			if !si.stoppedAt.IsZero() {
+				if launched, err := time.Parse(time.RFC3339, entry.Details["launch_time"]); err == nil {
+					addStopped(si, si.stoppedAt, launched)
+				}
+			}
+			si.stoppedAt = entry.Time
+		case actionStart:
+			if !si.stoppedAt.IsZero() {
+				addStopped(si, si.stoppedAt, entry.Time)
+			}
+			si.stoppedAt = time.Time{}
+		}
+	}
+
+	// instances still stopped at the end of the journal may have been started by hand since
+	if err := closeStopped(instances, now, addStopped); err != nil {
+		fmt.Printf("DescribeInstances fatal error: %s\n", err)
+		return RCERR
+	}
+
+	if c.csv {
+		fmt.Printf("Group, Key, Hours Stopped, Estimated Savings\n")
+		printSavings(perInstance, "instance", "%s,%s,%.1f,%.2f\n")
+		printSavings(perTag, "tag:"+c.tagKey, "%s,%s,%.1f,%.2f\n")
+		printSavings(perMonth, "month", "%s,%s,%.1f,%.2f\n")
+		fmt.Printf("total,,%.1f,%.2f\n", total.hours, total.savings)
+		return RCOK
+	}
+
+	fmt.Printf("\nSavings per instance\n")
+	printSavings(perInstance, "", "%s%s\t%.1f hours\t$%.2f\n")
+	fmt.Printf("\nSavings per %s tag\n", c.tagKey)
+	printSavings(perTag, "", "%s%s\t%.1f hours\t$%.2f\n")
+	fmt.Printf("\nSavings per month\n")
+	printSavings(perMonth, "", "%s%s\t%.1f hours\t$%.2f\n")
+	fmt.Printf("\nTotal: %.1f hours stopped, estimated savings $%.2f\n", total.hours, total.savings)
+
+	return RCOK
+}
+
+// closeStopped checks the current state of every instance still stopped at the end of the journal
+// and counts the hours until it was last launched or until now if it is still stopped
+func closeStopped(instances map[string]*stoppedInstance, now time.Time, addStopped func(*stoppedInstance, time.Time, time.Time)) error {
+
+	byRegion := make(map[string][]*string)
+	for _, si := range instances {
+		if !si.stoppedAt.IsZero() {
+			byRegion[si.region] = append(byRegion[si.region], aws.String(si.id))
+		}
+	}
+
+	for region, ids := range byRegion {
+
+		// Create an EC2 service object for the region the instances are in
+		// config values keys & sercet key read from environment
+		svc := ec2.New(session.New(), &aws.Config{MaxRetries: aws.Int(10), Region: aws.String(region)})
+
+		// use a filter so terminated instances that no longer exist do not cause an error
+		ec2dii := ec2.DescribeInstancesInput{
+			Filters: []*ec2.Filter{
+				&ec2.Filter{
+					Name:   aws.String("instance-id"),
+					Values: ids}}}
+
+		err := svc.DescribeInstancesPages(&ec2dii, func(p *ec2.DescribeInstancesOutput, lastPage bool) bool {
+			for _, reservation := range p.Reservations {
+				for _, instance := range reservation.Instances {
+					si := instances[*instance.InstanceId]
+					switch *instance.State.Name {
+					case ec2.InstanceStateNameStopped:
+						addStopped(si, si.stoppedAt, now)
+					default:
+						if instance.LaunchTime != nil && instance.LaunchTime.After(si.stoppedAt) {
+							addStopped(si, si.stoppedAt, *instance.LaunchTime)
+						}
+					}
+				}
+			}
+			return true
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// savingsLine returns the total for the key, creating it if needed
+func savingsLine(totals map[string]*savingsTotal, key string) *savingsTotal {
+	if totals[key] == nil {
+		totals[key] = &savingsTotal{}
+	}
+	return totals[key]
+}
+
+// printSavings displays each total sorted by key using the format provided
+func printSavings(totals map[string]*savingsTotal, group string, format string) {
+
+	var keys []string
+	for k := range totals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		fmt.Printf(format, group, k, totals[k].hours, totals[k].savings)
+	}
+}
+
+/*
+
+ */
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// autoSchedule holds the parsed value of an autostop tag such as
+// stop=19:00;start=07:30;days=Mon-Fri;tz=Australia/Sydney
+// An empty tag value, or any value that is not a schedule such as true, is the original
+// behaviour of stop whenever autostop runs.
+type autoSchedule struct {
+	always bool
+	legacy string // the value of an autostop tag that is not a schedule
+	start  int    // minutes past midnight or -1 if not set
+	stop   int    // minutes past midnight or -1 if not set
+	days   [7]bool
+	loc    *time.Location
+}
+
+// dayNames maps the short day names allowed in a schedule to a time.Weekday
+var dayNames = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// parseSchedule converts an autostop tag value into an autoSchedule
+func parseSchedule(value string) (*autoSchedule, error) {
+
+	s := &autoSchedule{start: -1, stop: -1, loc: time.Local}
+
+	if len(strings.TrimSpace(value)) == 0 {
+		s.always = true
+		return s, nil
+	}
+
+	// before schedules any value meant stop so values such as true or yes keep doing that
+	if !strings.Contains(value, "=") {
+		s.always, s.legacy = true, value
+		return s, nil
+	}
+
+	daysSet := false
+
+	for _, field := range strings.Split(value, ";") {
+		field = strings.TrimSpace(field)
+		if len(field) == 0 {
+			continue
+		}
+
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("schedule field %q is not in key=value format", field)
+		}
+
+		var err error
+		switch strings.ToLower(strings.TrimSpace(kv[0])) {
+		case "start":
+			s.start, err = parseTimeOfDay(kv[1])
+		case "stop":
+			s.stop, err = parseTimeOfDay(kv[1])
+		case "days":
+			s.days, err = parseDays(kv[1])
+			daysSet = true
+		case "tz":
+			s.loc, err = time.LoadLocation(strings.TrimSpace(kv[1]))
+		default:
+			err = fmt.Errorf("unknown schedule key %q", kv[0])
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if s.start < 0 && s.stop < 0 {
+		return nil, fmt.Errorf("schedule %q has neither a start nor a stop time", value)
+	}
+
+	if !daysSet {
+		for d := range s.days {
+			s.days[d] = true
+		}
+	}
+
+	return s, nil
+}
+
+// parseTimeOfDay converts a HH:MM string into minutes past midnight
+func parseTimeOfDay(value string) (int, error) {
+
+	t, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q. Expected HH:MM", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// parseDays converts a day list such as Mon-Fri or Mon,Wed,Fri into the days the schedule applies
+func parseDays(value string) (days [7]bool, err error) {
+
+	for _, part := range strings.Split(value, ",") {
+		part = strings.ToLower(strings.TrimSpace(part))
+
+		ends := strings.SplitN(part, "-", 2)
+		first, ok := dayNames[ends[0]]
+		if !ok {
+			return days, fmt.Errorf("invalid day %q in schedule", ends[0])
+		}
+		last := first
+		if len(ends) == 2 {
+			if last, ok = dayNames[ends[1]]; !ok {
+				return days, fmt.Errorf("invalid day %q in schedule", ends[1])
+			}
+		}
+
+		// ranges such as Fri-Mon wrap around the end of the week
+		for d := first; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+// running reports if the schedule says an instance should be running at the time provided
+func (s *autoSchedule) running(now time.Time) bool {
+
+	t := now.In(s.loc)
+	mins := t.Hour()*60 + t.Minute()
+	today := t.Weekday()
+
+	start, stop := s.start, s.stop
+	if start < 0 {
+		start = 0
+	}
+	if stop < 0 {
+		stop = 24 * 60
+	}
+
+	if start <= stop {
+		return s.days[today] && mins >= start && mins < stop
+	}
+
+	// overnight window such as start=20:00;stop=06:00 belongs to the day it started
+	if mins >= start {
+		return s.days[today]
+	}
+	if mins < stop {
+		return s.days[(today+6)%7]
+	}
+	return false
+}
+
+// the actions autostop can decide to take on an instance
+const (
+	actionNone  = "none"
+	actionSkip  = "skip"
+	actionStop  = "stop"
+	actionStart = "start"
+)
+
+// decide works out what should happen to an instance on this schedule that is currently
+// in the state provided and returns the action along with the reason for it.
+// Any date in the holiday calendar counts as a stop day.
+func (s *autoSchedule) decide(state string, now time.Time, holidays holidayCalendar) (action string, reason string) {
+
+	if s.always {
+		why := "autostop tag has no schedule"
+		if len(s.legacy) > 0 {
+			// reported in the decision reason rather than warned about as older tags are supported
+			why = fmt.Sprintf("autostop tag value %q is not a schedule so it is treated as always stop", s.legacy)
+		}
+		if state == ec2.InstanceStateNameRunning {
+			return actionStop, why
+		}
+		return actionNone, why + " and instance is " + state
+	}
+
+	local := now.In(s.loc)
+	holiday := holidays.isHoliday(local)
+	running := !holiday && s.running(now)
+
+	why := "outside running hours of schedule " + s.String()
+	if holiday {
+		why = local.Format("2006-01-02") + " is a holiday"
+	} else if running {
+		why = "inside running hours of schedule " + s.String()
+	}
+
+	switch state {
+	case ec2.InstanceStateNameRunning:
+		if holiday || (s.stop >= 0 && !running) {
+			return actionStop, why
+		}
+	case ec2.InstanceStateNameStopped:
+		if s.start >= 0 && running {
+			return actionStart, why
+		}
+	}
+	return actionNone, why + " and instance is " + state
+}
+
+// String returns a readable version of the schedule for use in output
+func (s *autoSchedule) String() string {
+
+	if s.always {
+		return "always stop"
+	}
+
+	var parts []string
+	if s.start >= 0 {
+		parts = append(parts, fmt.Sprintf("start=%02d:%02d", s.start/60, s.start%60))
+	}
+	if s.stop >= 0 {
+		parts = append(parts, fmt.Sprintf("stop=%02d:%02d", s.stop/60, s.stop%60))
+	}
+
+	var days []string
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if s.days[d] {
+			days = append(days, d.String()[:3])
+		}
+	}
+	parts = append(parts, "days="+strings.Join(days, ","))
+	parts = append(parts, "tz="+s.loc.String())
+
+	return strings.Join(parts, ";")
+}
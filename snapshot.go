@@ -4,21 +4,35 @@ import (
 	"flag"
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ssm"
 	"github.com/mitchellh/cli"
 )
 
 type SSCommand struct {
-	verbose    bool
-	dryrun     bool
-	automode   bool
-	reboot     bool
-	instanceId string
-	Ui         cli.Ui
+	verbose     bool
+	dryrun      bool
+	automode    bool
+	reboot      bool
+	timeout     int
+	instanceId  string
+	copyTags    string
+	retention   string
+	drRegion    string
+	kmsKey      string
+	volumes     bool
+	rds         bool
+	devices     string
+	hookFile    string
+	hookTimeout int
+	hooks       hookConfig
+	ssmsvc      *ssm.SSM
+	Ui          cli.Ui
 }
 
 // Help function displays detailed help for ths snapshot sub command
@@ -35,7 +49,52 @@ func (c *SSCommand) Help() string {
 	-i <instanceid> to snapshot one EC2 instance
 	-n - Dry run. Report what would have happened but make no changes
 	-f force an instance reboot when making the snapshot
+	-t <minutes> - time to wait for the AMI's to become available. default 60
+	--copy-tags <keys> - comma separated instance tag keys to copy to the AMI and
+		its snapshots, or all to copy every tag. default Name
+	--retention <policy> - retention policy recorded on the AMI. default default
+	--copy-to-region <region> - copy each AMI to this DR region once it is available
+	--kms-key <key> - KMS key id or arn in the DR region to encrypt the copies with
+	--volumes - snapshot EBS volumes instead of creating AMI's
+	--rds - create manual snapshots of RDS DB instances instead of AMI's
+	--devices <names> - in volume mode comma separated device names to snapshot
+		on instances tagged autobkup such as /dev/sdf
+	--hooks <file> - json file of SSM pre and post hooks per instance id or Name
+	--hook-timeout <seconds> - time allowed for each hook. default 300
 	-v to produce verbose output
+
+	Hooks make AMI's application consistent. The pre hook, such as a freeze or
+	flush script, is run on the instance with SSM before CreateImage and the post
+	hook, such as a thaw script, is run once the AMI has been started. If the pre
+	hook fails or times out no AMI is created for the instance. Hooks are set in
+	the hook file as {"i-0123": {"pre": "cmd", "post": "cmd"}} or with instance
+	tags autobkup-pre-hook and autobkup-post-hook. The SSM document defaults to
+	AWS-RunShellScript and can be set with document or autobkup-hook-document.
+
+	In volume mode volumes with a tag key of autobkup are snapshotted along with
+	the volumes of instances tagged autobkup that are attached on the devices in
+	--devices or in the instance autobkup-devices tag. With -i every volume of the
+	instance is snapshotted unless devices are given. The snapshots are tagged
+	with autocleanup and autobkup-source-volume, and with autobkup-source-instance
+	when the volume is attached. They expire per source volume with ami-cleanup
+	like AMI's do.
+
+	In RDS mode DB instances with a tag key of autobkup, or the DB instance given
+	with -i, get a manual DB snapshot named autobkup-<db>-<time>. The snapshots
+	are tagged like AMI's, copied to the autobkup-dr or --copy-to-region region
+	and expire with ami-cleanup --rds. Snapshots of encrypted DB instances are
+	not copied to a DR region.
+
+	An instance tag of autobkup-dr=<region> copies its AMI's to that region
+	instead of the --copy-to-region region. Copies keep the AMI tags and are
+	cleaned up by ami-cleanup with the same retention.
+
+	The AMI and its snapshots are also tagged with the source instance in
+	autobkup-source-instance, autobkup-created-by and the retention policy in
+	autobkup-retention. An instance tag of autobkup-retention overrides --retention.
+
+	Each AMI is tagged as soon as it is created. The run ends with a report of
+	the AMI's that are available, still pending or failed.
 	`
 }
 
@@ -55,6 +114,16 @@ func (c *SSCommand) Run(args []string) int {
 	cmdFlags.BoolVar(&c.reboot, "f", false, "Reboot instance wehn making snapshot. default: false")
 	cmdFlags.BoolVar(&c.automode, "a", false, "auto mode to snapshot any instance with a tag key of autobkup")
 	cmdFlags.StringVar(&c.instanceId, "i", "", "instance to be backed up")
+	cmdFlags.StringVar(&c.copyTags, "copy-tags", "Name", "Instance tag keys to copy or all")
+	cmdFlags.StringVar(&c.retention, "retention", "default", "Retention policy recorded on the AMI")
+	cmdFlags.StringVar(&c.drRegion, "copy-to-region", "", "DR region to copy AMI's to")
+	cmdFlags.StringVar(&c.kmsKey, "kms-key", "", "KMS key to encrypt DR copies with")
+	cmdFlags.BoolVar(&c.volumes, "volumes", false, "Snapshot EBS volumes instead of creating AMI's")
+	cmdFlags.BoolVar(&c.rds, "rds", false, "Snapshot RDS DB instances instead of creating AMI's")
+	cmdFlags.StringVar(&c.devices, "devices", "", "Device names to snapshot in volume mode")
+	cmdFlags.StringVar(&c.hookFile, "hooks", "", "SSM hook file")
+	cmdFlags.IntVar(&c.hookTimeout, "hook-timeout", 300, "Seconds allowed for each hook")
+	cmdFlags.IntVar(&c.timeout, "t", 60, "Minutes to wait for the AMI's to become available")
 	if err := cmdFlags.Parse(args); err != nil {
 		return 1
 	}
@@ -65,12 +134,26 @@ func (c *SSCommand) Run(args []string) int {
 		return RCERR
 	}
 
+	var err error
+	if c.hooks, err = loadHooks(c.hookFile); err != nil {
+		fmt.Printf("Fatal error: unable to load hooks - %s\n", err)
+		return RCERR
+	}
+
 	// Create an EC2 service object
 	// config values keys, sercet key & region read from environment
 	svc := ec2.New(session.New(), &aws.Config{MaxRetries: aws.Int(10)})
 
+	if c.volumes {
+		return c.snapshotVolumes(svc)
+	}
+
+	if c.rds {
+		return c.snapshotRDS(svc)
+	}
+
 	// load the struct that has details on all instances to be snapshotted
-	bkupInstances, err := getBkupInstances(svc, c.instanceId, c.reboot)
+	bkupInstances, instanceTags, err := getBkupInstances(svc, c.instanceId, c.reboot)
 
 	if err != nil {
 		// AWS DescribeInstances failed
@@ -78,72 +161,366 @@ func (c *SSCommand) Run(args []string) int {
 		return RCERR
 	}
 
-	// amis contains the list of AMI's that have been created and need tagged
-	var amis []string
+	cleanupTag := &ec2.Tag{
+		Key:   aws.String("autocleanup"),
+		Value: aws.String(strconv.FormatInt(time.Now().Unix(), 10))}
+
+	// images contains the AMI's that have been created and need to become available
+	var images []*createdImage
 
 	// now we have the slice of instanceIds to be backed up we can create the AMI then tag them
 	for _, abkupInstance := range bkupInstances {
 
 		if c.dryrun == false {
 			// snapshot the instance.
-			createImageResp, err := svc.CreateImage(abkupInstance)
+			createImageResp, err := c.hookedCreateImage(svc, abkupInstance, instanceTags[*abkupInstance.InstanceId])
 
 			if err != nil {
 				fmt.Printf("Error creating AWS AMI for instance %s\n", *abkupInstance.InstanceId)
 				fmt.Printf("Error details - %s\n", err)
-			} else {
-				if c.verbose {
-					fmt.Printf("Info - Started creating AMI: %s\n", *createImageResp.ImageId)
-				}
-				// add the amiid to the list of ami's to tag
-				amis = append(amis, *createImageResp.ImageId)
+				continue
+			}
+			if c.verbose {
+				fmt.Printf("Info - Started creating AMI: %s\n", *createImageResp.ImageId)
+			}
+
+			image := &createdImage{
+				imageId:    *createImageResp.ImageId,
+				instanceId: *abkupInstance.InstanceId,
+				name:       *abkupInstance.Name,
+				state:      ec2.ImageStatePending,
+				drRegion:   c.drRegion,
+				tags:       imageTags(*abkupInstance.InstanceId, instanceTags[*abkupInstance.InstanceId], c.copyTags, c.retention)}
+			if dr := tagValue(instanceTags[image.instanceId], "autobkup-dr"); len(dr) > 0 {
+				image.drRegion = dr
+			}
+			images = append(images, image)
+
+			// tag straight away so ami-cleanup finds the AMI even if this run is interrupted
+			if err = tagImage(svc, image.imageId, append([]*ec2.Tag{cleanupTag}, image.tags...)); err != nil {
+				fmt.Printf("Warning - problem adding tags to AMI: %s. Error was %s\n", *createImageResp.ImageId, err)
+			} else if c.verbose {
+				fmt.Printf("Info - Tagged AMI: %s\n", *createImageResp.ImageId)
 			}
 		} else {
+			hook := c.hooks.forInstance(*abkupInstance.InstanceId, instanceTags[*abkupInstance.InstanceId])
+			if len(hook.Pre) > 0 {
+				fmt.Printf("Dry Run - Would have run pre hook on instance %s: %s\n", *abkupInstance.InstanceId, hook.Pre)
+			}
 			fmt.Printf("Dry Run - Would have created AMI for instance %s\n", *abkupInstance.InstanceId)
+			if len(hook.Post) > 0 {
+				fmt.Printf("Dry Run - Would have run post hook on instance %s: %s\n", *abkupInstance.InstanceId, hook.Post)
+			}
+			dr := c.drRegion
+			if tagDr := tagValue(instanceTags[*abkupInstance.InstanceId], "autobkup-dr"); len(tagDr) > 0 {
+				dr = tagDr
+			}
+			if len(dr) > 0 {
+				fmt.Printf("Dry Run - Would have copied the AMI to DR region %s\n", dr)
+			}
 		}
 	}
 
 	// if no AMI's created then lets leave
-	if len(amis) == 0 {
+	if len(images) == 0 {
 		return RCOK
 	}
 
 	if c.verbose {
-		fmt.Printf("AMI's creation has started. Now waiting for AWS to make AMI's available to tag...\n")
+		fmt.Printf("AMI's creation has started. Now waiting up to %d minutes for AWS to make AMI's available...\n", c.timeout)
+	}
+	waitForImages(svc, images, time.Duration(c.timeout)*time.Minute)
+	tagImageSnapshots(svc, images, c.verbose)
+	copyToDR(svc, images, cleanupTag, c.kmsKey, c.verbose)
+
+	return imageReport(images)
+}
+
+// hookedCreateImage runs the pre hook of the instance, creates the AMI and then runs the post hook.
+// No AMI is created if the pre hook fails. The post hook is run whatever happens so the instance
+// is never left frozen
+func (c *SSCommand) hookedCreateImage(svc *ec2.EC2, input *ec2.CreateImageInput, tags []*ec2.Tag) (*ec2.CreateImageOutput, error) {
+
+	hook := c.hooks.forInstance(*input.InstanceId, tags)
+
+	if (len(hook.Pre) > 0 || len(hook.Post) > 0) && c.ssmsvc == nil {
+		// Create an SSM service object
+		// config values keys, sercet key & region read from environment
+		c.ssmsvc = ssm.New(session.New(), &aws.Config{MaxRetries: aws.Int(10)})
+	}
+
+	timeout := time.Duration(c.hookTimeout) * time.Second
+
+	// postHook runs the post hook and reports a failure as it may leave the instance frozen
+	postHook := func() {
+		if len(hook.Post) == 0 {
+			return
+		}
+		if err := runHook(c.ssmsvc, *input.InstanceId, hook.Document, hook.Post, timeout); err != nil {
+			fmt.Printf("Error - post hook failed on instance %s. Check the instance. Error details - %s\n", *input.InstanceId, err)
+		} else if c.verbose {
+			fmt.Printf("Info - Post hook finished on instance %s\n", *input.InstanceId)
+		}
+	}
+
+	if len(hook.Pre) > 0 {
+		if c.verbose {
+			fmt.Printf("Info - Running pre hook on instance %s\n", *input.InstanceId)
+		}
+		if err := runHook(c.ssmsvc, *input.InstanceId, hook.Document, hook.Pre, timeout); err != nil {
+			// the pre hook may have partly run so still undo it
+			postHook()
+			return nil, fmt.Errorf("pre hook failed so the AMI was skipped rather than taken inconsistent: %s", err)
+		}
 	}
-	time.Sleep(47 * time.Second)
 
-	theTags := []*ec2.Tag{
-		&ec2.Tag{
-			Key:   aws.String("autocleanup"),
-			Value: aws.String(strconv.FormatInt(time.Now().Unix(), 10))}}
+	createImageResp, err := svc.CreateImage(input)
+	postHook()
+
+	return createImageResp, err
+}
+
+// createdImage tracks an AMI created by the snapshot command until it becomes available
+type createdImage struct {
+	imageId    string
+	instanceId string
+	name       string
+	state      string
+	tags       []*ec2.Tag
+	snapshots  []*string
+	drRegion   string
+	drImageId  string
+}
+
+// imageTags returns the instance tags selected by copyTags, either a comma separated list of
+// keys or all, along with the provenance tags for an AMI and its snapshots
+func imageTags(instanceId string, instanceTags []*ec2.Tag, copyTags string, retention string) (tags []*ec2.Tag) {
+
+	keys := make(map[string]bool)
+	for _, key := range splitIds(copyTags) {
+		keys[*key] = true
+	}
 
-	for _, ami := range amis {
+	for _, tag := range instanceTags {
+		key := safeString(tag.Key)
+		if key == "autobkup-retention" && len(safeString(tag.Value)) > 0 {
+			retention = safeString(tag.Value)
+		}
+
+		// aws: tags are reserved and the provenance tags are set below
+		if strings.HasPrefix(key, "aws:") || strings.HasPrefix(key, "autobkup-") || key == "autocleanup" {
+			continue
+		}
+		if keys["all"] || keys[key] {
+			tags = append(tags, &ec2.Tag{Key: tag.Key, Value: tag.Value})
+		}
+	}
+
+	// snapshots of unattached volumes have no source instance
+	if len(instanceId) > 0 {
+		tags = append(tags, &ec2.Tag{Key: aws.String("autobkup-source-instance"), Value: aws.String(instanceId)})
+	}
+
+	return append(tags,
+		&ec2.Tag{Key: aws.String("autobkup-created-by"), Value: aws.String("awsgo-tools snapshot")},
+		&ec2.Tag{Key: aws.String("autobkup-retention"), Value: aws.String(retention)})
+}
+
+// tagImageSnapshots copies the AMI tags onto the snapshots in its block device mappings
+func tagImageSnapshots(svc *ec2.EC2, images []*createdImage, verbose bool) {
+
+	for _, image := range images {
+
+		if len(image.snapshots) == 0 {
+			if image.state != ec2.ImageStateFailed {
+				fmt.Printf("Warning - snapshots of AMI: %s not known yet and have not been tagged\n", image.imageId)
+			}
+			continue
+		}
 
 		ec2cti := ec2.CreateTagsInput{
-			Resources: []*string{aws.String(ami)},
-			Tags:      theTags}
+			Resources: image.snapshots,
+			Tags:      image.tags}
 
-		// call the create tag func
-		_, err = svc.CreateTags(&ec2cti)
+		if _, err := svc.CreateTags(&ec2cti); err != nil {
+			fmt.Printf("Warning - problem adding tags to snapshots of AMI: %s. Error was %s\n", image.imageId, err)
+		} else if verbose {
+			fmt.Printf("Info - Tagged %d snapshots of AMI: %s\n", len(image.snapshots), image.imageId)
+		}
+	}
+}
+
+// tagImage tags a newly created AMI. A new AMI can take a moment to be visible to
+// CreateTags so retry a few times while it is reported as not found
+func tagImage(svc *ec2.EC2, imageId string, tags []*ec2.Tag) (err error) {
 
+	ec2cti := ec2.CreateTagsInput{
+		Resources: []*string{aws.String(imageId)},
+		Tags:      tags}
+
+	for attempt := 1; attempt <= 5; attempt++ {
+		if _, err = svc.CreateTags(&ec2cti); errorCode(err) != "InvalidAMIID.NotFound" {
+			return err
+		}
+		time.Sleep(time.Duration(attempt) * 2 * time.Second)
+	}
+	return err
+}
+
+// waitForImages waits for the pending AMI's to become available or fail and updates
+// the state of each one. It gives up once the timeout has passed
+func waitForImages(svc *ec2.EC2, images []*createdImage, timeout time.Duration) {
+
+	deadline := time.Now().Add(timeout)
+
+	for time.Now().Before(deadline) {
+
+		byId := make(map[string]*createdImage)
+		var pending []*string
+		for _, image := range images {
+			if image.state == ec2.ImageStatePending {
+				byId[image.imageId] = image
+				pending = append(pending, aws.String(image.imageId))
+			}
+		}
+		if len(pending) == 0 {
+			return
+		}
+
+		ec2dii := ec2.DescribeImagesInput{ImageIds: pending}
+
+		// the waiter returns early when any AMI fails so check each state whatever the result
+		waitErr := waitTimeout(deadline.Sub(time.Now()), func() error {
+			return svc.WaitUntilImageAvailable(&ec2dii)
+		})
+
+		resp, err := svc.DescribeImages(&ec2dii)
 		if err != nil {
-			fmt.Printf("Warning - problem adding tags to AMI: %s. Error was %s\n", ami, err)
+			fmt.Printf("Warning - unable to check AMI state: %s\n", err)
+			return
 		}
-		if c.verbose {
-			fmt.Printf("Info - Tagged AMI: %s\n", ami)
+		for _, image := range resp.Images {
+			created := byId[*image.ImageId]
+			created.state = safeString(image.State)
+			created.snapshots = nil
+			for _, bdm := range image.BlockDeviceMappings {
+				if bdm.Ebs != nil && len(safeString(bdm.Ebs.SnapshotId)) > 0 {
+					created.snapshots = append(created.snapshots, bdm.Ebs.SnapshotId)
+				}
+			}
+		}
+
+		if waitErr != nil && !time.Now().Before(deadline) {
+			return
 		}
 	}
+}
 
-	if c.verbose {
-		fmt.Printf("All done.\n")
+// copyToDR copies each available AMI with a DR region into that region with the same tags,
+// encrypting the copy with the KMS key if one is provided. The source AMI is tagged with
+// autobkup-dr-copy so ami-cleanup can find the copy
+func copyToDR(svc *ec2.EC2, images []*createdImage, cleanupTag *ec2.Tag, kmsKey string, verbose bool) {
+
+	region := safeString(svc.Config.Region)
+	drsvcs := make(map[string]*ec2.EC2)
+
+	for _, image := range images {
+
+		if len(image.drRegion) == 0 || image.drRegion == region {
+			continue
+		}
+		if image.state != ec2.ImageStateAvailable {
+			fmt.Printf("Warning - AMI: %s is %s and has not been copied to DR region %s\n", image.imageId, image.state, image.drRegion)
+			continue
+		}
+
+		drsvc := drsvcs[image.drRegion]
+		if drsvc == nil {
+			// Create an EC2 service object for the DR region
+			// config values keys & sercet key read from environment
+			drsvc = ec2.New(session.New(), &aws.Config{MaxRetries: aws.Int(10), Region: aws.String(image.drRegion)})
+			drsvcs[image.drRegion] = drsvc
+		}
+
+		ec2cii := ec2.CopyImageInput{
+			SourceImageId: aws.String(image.imageId),
+			SourceRegion:  aws.String(region),
+			Name:          aws.String(image.name),
+			Description:   aws.String("DR copy of " + image.imageId + " from " + region)}
+
+		if len(kmsKey) > 0 {
+			ec2cii.Encrypted = aws.Bool(true)
+			ec2cii.KmsKeyId = aws.String(kmsKey)
+		}
+
+		copyResp, err := drsvc.CopyImage(&ec2cii)
+		if err != nil {
+			fmt.Printf("Error copying AMI: %s to DR region %s. Error details - %s\n", image.imageId, image.drRegion, err)
+			continue
+		}
+		image.drImageId = *copyResp.ImageId
+
+		if verbose {
+			fmt.Printf("Info - Started copying AMI: %s to %s in DR region %s\n", image.imageId, image.drImageId, image.drRegion)
+		}
+
+		drTags := append([]*ec2.Tag{cleanupTag}, image.tags...)
+		drTags = append(drTags,
+			&ec2.Tag{Key: aws.String("autobkup-source-image"), Value: aws.String(image.imageId)},
+			&ec2.Tag{Key: aws.String("autobkup-source-region"), Value: aws.String(region)})
+
+		if err = tagImage(drsvc, image.drImageId, drTags); err != nil {
+			fmt.Printf("Warning - problem adding tags to DR AMI: %s. Error was %s\n", image.drImageId, err)
+		}
+
+		copyTag := []*ec2.Tag{
+			&ec2.Tag{
+				Key:   aws.String("autobkup-dr-copy"),
+				Value: aws.String(image.drRegion + "/" + image.drImageId)}}
+
+		if err = tagImage(svc, image.imageId, copyTag); err != nil {
+			fmt.Printf("Warning - problem adding tags to AMI: %s. Error was %s\n", image.imageId, err)
+		}
+	}
+}
+
+// imageReport displays the AMI's that are available, still pending and failed. It returns
+// an error code if any AMI failed
+func imageReport(images []*createdImage) int {
+
+	var available, pending, failed []*createdImage
+	for _, image := range images {
+		switch image.state {
+		case ec2.ImageStateAvailable:
+			available = append(available, image)
+		case ec2.ImageStatePending:
+			pending = append(pending, image)
+		default:
+			failed = append(failed, image)
+		}
+	}
+
+	fmt.Printf("AMI report - available: %d pending: %d failed: %d\n", len(available), len(pending), len(failed))
+	for _, group := range [][]*createdImage{available, pending, failed} {
+		for _, image := range group {
+			fmt.Printf("AMI: %s\tInstance: %s\tState: %s", image.imageId, image.instanceId, image.state)
+			if len(image.drImageId) > 0 {
+				fmt.Printf("\tDR copy: %s in %s", image.drImageId, image.drRegion)
+			}
+			fmt.Printf("\n")
+		}
+	}
+
+	if len(failed) > 0 {
+		return RCERR
 	}
 	return RCOK
 }
 
 // getBkupInstances will return a slice of CreateImageInput structures for either a single instance
 // or all instances in an account that have a tag key of autobkup
-func getBkupInstances(svc *ec2.EC2, bkupId string, reboot bool) (bkupInstances []*ec2.CreateImageInput, err error) {
+// along with the tags of each instance keyed by instanceId
+func getBkupInstances(svc *ec2.EC2, bkupId string, reboot bool) (bkupInstances []*ec2.CreateImageInput, instanceTags map[string][]*ec2.Tag, err error) {
 
 	var instanceSlice []*string
 	var ec2Filter ec2.Filter
@@ -164,9 +541,11 @@ func getBkupInstances(svc *ec2.EC2, bkupId string, reboot bool) (bkupInstances [
 	resp, err := svc.DescribeInstances(&ec2dii)
 
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
+	instanceTags = make(map[string][]*ec2.Tag)
+
 	// for any instance found extract tag name and instanceid
 	for reservation := range resp.Reservations {
 		for instance := range resp.Reservations[reservation].Instances {
@@ -190,11 +569,12 @@ func getBkupInstances(svc *ec2.EC2, bkupId string, reboot bool) (bkupInstances [
 			}
 			theInstance.Description = aws.String("Auto backup of instance " + *resp.Reservations[reservation].Instances[instance].InstanceId)
 			theInstance.InstanceId = resp.Reservations[reservation].Instances[instance].InstanceId
+			instanceTags[*theInstance.InstanceId] = resp.Reservations[reservation].Instances[instance].Tags
 			// swap value as the question is NoReboot?
 			theInstance.NoReboot = aws.Bool(!reboot)
 			// append details on this instance to the slice
 			bkupInstances = append(bkupInstances, &theInstance)
 		}
 	}
-	return bkupInstances, nil
+	return bkupInstances, instanceTags, nil
 }
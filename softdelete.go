@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+const (
+	// pendingDeleteTag holds the time an AMI or snapshot was marked for deletion
+	pendingDeleteTag = "pending-delete"
+	// pendingPermissionsTag holds the launch permissions revoked when an AMI was marked
+	pendingPermissionsTag = "pending-delete-permissions"
+	// exemptTag holds the time undelete exempted an AMI or snapshot from ami-cleanup
+	exemptTag = "autocleanup-exempt"
+)
+
+// pendingDeleteSince returns the time in the pending-delete tag and false if the tag is missing
+// or not a valid time
+func pendingDeleteSince(tags []*ec2.Tag) (time.Time, bool) {
+	since, err := time.Parse(time.RFC3339, tagValue(tags, pendingDeleteTag))
+	return since, err == nil
+}
+
+// exempt keeps the AMI's and snapshots that undelete has exempted from cleanup
+func exempt(decisions []*retainedBackup) {
+	for _, ri := range decisions {
+		if since := tagValue(ri.tags, exemptTag); len(since) > 0 {
+			ri.keep, ri.reason = true, fmt.Sprintf("exempted by undelete at %s. Remove the %s tag to clean it up", since, exemptTag)
+		}
+	}
+}
+
+// unmarkKept clears the pending-delete state of the AMI's that are now kept, such as after a
+// policy change or because they are in use again, so a later deletion starts a new grace period
+func (c *AMICommand) unmarkKept(svc *ec2.EC2, decisions []*retainedBackup) int {
+
+	rc := RCOK
+	for _, ri := range decisions {
+		if _, pending := pendingDeleteSince(ri.tags); !ri.keep || !pending || ri.image == nil {
+			continue
+		}
+		if err := unmarkImage(svc, ri.image, c.dryrun, c.verbose); err != nil {
+			fmt.Printf("error clearing pending-delete on AMI %s. Error details - %s\n", ri.id, err)
+			rc = RCERR
+			continue
+		}
+		ri.reason += ". pending-delete cleared"
+	}
+	return rc
+}
+
+// softDelete applies the grace period to the AMI's due for deletion. An AMI without a
+// pending-delete tag is marked and kept, an AMI marked less than the grace period ago is kept
+// and an AMI marked before that is left to be deleted
+func (c *AMICommand) softDelete(svc *ec2.EC2, decisions []*retainedBackup, now time.Time) int {
+
+	rc := RCOK
+	grace := time.Duration(c.grace) * 24 * time.Hour
+
+	for _, ri := range decisions {
+
+		if ri.keep {
+			continue
+		}
+
+		since, pending := pendingDeleteSince(ri.tags)
+		switch {
+		case !pending:
+			if err := c.markImage(svc, ri.image, now); err != nil {
+				fmt.Printf("error marking AMI %s pending-delete. Error details - %s\n", ri.id, err)
+				rc = RCERR
+			}
+			ri.keep = true
+			ri.reason = fmt.Sprintf("marked pending-delete, deleted after %s. was %s", now.Add(grace).UTC().Format(time.RFC3339), ri.reason)
+		case now.Sub(since) < grace:
+			ri.keep = true
+			ri.reason = fmt.Sprintf("pending-delete until %s. was %s", since.Add(grace).UTC().Format(time.RFC3339), ri.reason)
+		default:
+			ri.reason += fmt.Sprintf(". pending-delete since %s", since.UTC().Format(time.RFC3339))
+		}
+	}
+	return rc
+}
+
+// markImage revokes the launch permissions of an AMI, recording them so undelete can restore
+// them, and tags the AMI and its snapshots pending-delete
+func (c *AMICommand) markImage(svc *ec2.EC2, image *ec2.Image, now time.Time) error {
+
+	ec2diai := ec2.DescribeImageAttributeInput{
+		ImageId:   image.ImageId,
+		Attribute: aws.String(ec2.ImageAttributeNameLaunchPermission)}
+
+	attrResp, err := svc.DescribeImageAttribute(&ec2diai)
+	if err != nil {
+		return err
+	}
+
+	var permissions []string
+	for _, perm := range attrResp.LaunchPermissions {
+		if safeString(perm.Group) == ec2.PermissionGroupAll {
+			permissions = append(permissions, ec2.PermissionGroupAll)
+		} else if len(safeString(perm.UserId)) > 0 {
+			permissions = append(permissions, *perm.UserId)
+		}
+	}
+
+	tags := []*ec2.Tag{
+		&ec2.Tag{Key: aws.String(pendingDeleteTag), Value: aws.String(now.UTC().Format(time.RFC3339))}}
+	if len(permissions) > 0 {
+		tags = append(tags, &ec2.Tag{Key: aws.String(pendingPermissionsTag), Value: aws.String(strings.Join(permissions, ","))})
+	}
+
+	resources := []*string{image.ImageId}
+	for _, snapshotId := range imageSnapshots(image) {
+		resources = append(resources, aws.String(snapshotId))
+	}
+
+	if c.dryrun {
+		if len(permissions) > 0 {
+			fmt.Printf("Dry Run - Would have revoked launch permission on AMI %s for %s\n", *image.ImageId, strings.Join(permissions, ","))
+		}
+		fmt.Printf("Dry Run - Would have tagged AMI %s and its snapshots %s\n", *image.ImageId, pendingDeleteTag)
+		return nil
+	}
+
+	// record the permissions before revoking them so they are never lost
+	if _, err := svc.CreateTags(&ec2.CreateTagsInput{Resources: resources, Tags: tags}); err != nil {
+		return err
+	}
+	if c.verbose {
+		fmt.Printf("Info - Tagged AMI %s and its snapshots %s\n", *image.ImageId, pendingDeleteTag)
+	}
+
+	if len(attrResp.LaunchPermissions) > 0 {
+		ec2miai := ec2.ModifyImageAttributeInput{
+			ImageId:          image.ImageId,
+			LaunchPermission: &ec2.LaunchPermissionModifications{Remove: attrResp.LaunchPermissions}}
+		if _, err := svc.ModifyImageAttribute(&ec2miai); err != nil {
+			return err
+		}
+		if c.verbose {
+			fmt.Printf("Info - Revoked launch permission on AMI %s for %s\n", *image.ImageId, strings.Join(permissions, ","))
+		}
+	}
+	return nil
+}
+
+// softDeleteSnapshot applies the grace period to a volume snapshot due for deletion. It returns
+// true if the snapshot can be deleted now
+func (c *AMICommand) softDeleteSnapshot(svc *ec2.EC2, snapshot *ec2.Snapshot, now time.Time) (bool, error) {
+
+	grace := time.Duration(c.grace) * 24 * time.Hour
+
+	since, pending := pendingDeleteSince(snapshot.Tags)
+	switch {
+	case pending && now.Sub(since) >= grace:
+		return true, nil
+	case pending:
+		if c.verbose || c.dryrun {
+			fmt.Printf("Info - Not deleting volume snapshot: %s as pending-delete until %s\n", *snapshot.SnapshotId,
+				since.Add(grace).UTC().Format(time.RFC3339))
+		}
+		return false, nil
+	case c.dryrun:
+		fmt.Printf("Dry Run - Would have tagged volume snapshot %s %s\n", *snapshot.SnapshotId, pendingDeleteTag)
+		return false, nil
+	}
+
+	ec2cti := ec2.CreateTagsInput{
+		Resources: []*string{snapshot.SnapshotId},
+		Tags: []*ec2.Tag{
+			&ec2.Tag{Key: aws.String(pendingDeleteTag), Value: aws.String(now.UTC().Format(time.RFC3339))}}}
+	if _, err := svc.CreateTags(&ec2cti); err != nil {
+		return false, err
+	}
+	if c.verbose {
+		fmt.Printf("Info - Tagged volume snapshot %s %s\n", *snapshot.SnapshotId, pendingDeleteTag)
+	}
+	return false, nil
+}
+
+// unmarkImage grants the launch permissions recorded when the AMI was marked pending-delete
+// and clears the pending state on the AMI and its snapshots
+func unmarkImage(svc *ec2.EC2, image *ec2.Image, dryrun bool, verbose bool) error {
+
+	var launch []*ec2.LaunchPermission
+	for _, permission := range splitIds(tagValue(image.Tags, pendingPermissionsTag)) {
+		if *permission == ec2.PermissionGroupAll {
+			launch = append(launch, &ec2.LaunchPermission{Group: permission})
+		} else {
+			launch = append(launch, &ec2.LaunchPermission{UserId: permission})
+		}
+	}
+
+	if len(launch) > 0 {
+		permissions := tagValue(image.Tags, pendingPermissionsTag)
+		if dryrun {
+			fmt.Printf("Dry Run - Would have granted launch permission on AMI %s for %s\n", *image.ImageId, permissions)
+		} else {
+			ec2miai := ec2.ModifyImageAttributeInput{
+				ImageId:          image.ImageId,
+				LaunchPermission: &ec2.LaunchPermissionModifications{Add: launch}}
+			if _, err := svc.ModifyImageAttribute(&ec2miai); err != nil {
+				return err
+			}
+			if verbose {
+				fmt.Printf("Info - Granted launch permission on AMI %s for %s\n", *image.ImageId, permissions)
+			}
+		}
+	}
+
+	resources := []*string{image.ImageId}
+	for _, snapshotId := range imageSnapshots(image) {
+		resources = append(resources, aws.String(snapshotId))
+	}
+	return clearPending(svc, resources, dryrun, verbose)
+}
+
+// clearPending removes the pending-delete tags from the resources
+func clearPending(svc *ec2.EC2, resources []*string, dryrun bool, verbose bool) error {
+
+	var ids []string
+	for _, id := range resources {
+		ids = append(ids, *id)
+	}
+
+	if dryrun {
+		fmt.Printf("Dry Run - Would have cleared %s on %s\n", pendingDeleteTag, strings.Join(ids, ","))
+		return nil
+	}
+
+	ec2dti := ec2.DeleteTagsInput{
+		Resources: resources,
+		Tags: []*ec2.Tag{
+			&ec2.Tag{Key: aws.String(pendingDeleteTag)},
+			&ec2.Tag{Key: aws.String(pendingPermissionsTag)}}}
+
+	if _, err := svc.DeleteTags(&ec2dti); err != nil {
+		return err
+	}
+	if verbose {
+		fmt.Printf("Info - Cleared %s on %s\n", pendingDeleteTag, strings.Join(ids, ","))
+	}
+	return nil
+}
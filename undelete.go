@@ -0,0 +1,190 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/mitchellh/cli"
+)
+
+type UndeleteCommand struct {
+	verbose  bool
+	dryrun   bool
+	automode bool
+	id       string
+	Ui       cli.Ui
+}
+
+// Help function displays detailed help for the undelete sub command
+func (c *UndeleteCommand) Help() string {
+	return `
+	Description:
+	Clear the pending-delete state set by ami-cleanup --grace. The pending-delete
+	tag is removed from the AMI and its snapshots, the launch permissions
+	revoked when the AMI was marked are granted again and the AMI and its
+	snapshots are exempted from ami-cleanup.
+
+	Usage:
+		awsgo-tools undelete [flags]
+
+	Flags:
+	-i <id> - AMI or volume snapshot id to undelete
+	-a - undelete every AMI and volume snapshot that is pending-delete
+	-n - Dry run. Report what would have happened but make no changes
+	-v - Produce verbose output
+
+	Undeleted AMI's and snapshots are tagged autocleanup-exempt so ami-cleanup
+	keeps them and does not mark them again. Remove the autocleanup-exempt tag to
+	let ami-cleanup clean them up under their retention policy again.
+	`
+}
+
+// Synopsis function returns a string with concise details of the sub command
+func (c *UndeleteCommand) Synopsis() string {
+	return "Clear pending-delete on AMI's & snapshots"
+}
+
+// Run function is the function called by the cli library to run the actual sub command code.
+func (c *UndeleteCommand) Run(args []string) int {
+
+	cmdFlags := flag.NewFlagSet("undelete", flag.ContinueOnError)
+	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+
+	cmdFlags.BoolVar(&c.verbose, "v", false, "Produce verbose output")
+	cmdFlags.BoolVar(&c.dryrun, "n", false, "Dry Run")
+	cmdFlags.BoolVar(&c.automode, "a", false, "Undelete everything pending-delete")
+	cmdFlags.StringVar(&c.id, "i", "", "AMI or snapshot to undelete")
+	if err := cmdFlags.Parse(args); err != nil {
+		return RCERR
+	}
+
+	// make sure we are in auto mode or an id has been provided
+	if !c.automode && len(c.id) == 0 {
+		fmt.Printf("No AMI or snapshot provided. Please provide an id to undelete\nor use -a to undelete everything pending-delete.\n")
+		return RCERR
+	}
+
+	// Create an EC2 service object
+	// config values keys, sercet key & region read from environment
+	svc := ec2.New(session.New(), &aws.Config{MaxRetries: aws.Int(10)})
+
+	pendingFilter := &ec2.Filter{
+		Name:   aws.String("tag-key"),
+		Values: []*string{aws.String(pendingDeleteTag)}}
+
+	rc := RCOK
+
+	if c.automode || strings.HasPrefix(c.id, "ami-") {
+
+		ec2dii := ec2.DescribeImagesInput{Owners: []*string{aws.String("self")}, Filters: []*ec2.Filter{pendingFilter}}
+		if !c.automode {
+			ec2dii = ec2.DescribeImagesInput{ImageIds: []*string{aws.String(c.id)}}
+		}
+
+		imagesResp, err := svc.DescribeImages(&ec2dii)
+		if err != nil {
+			fmt.Printf("Fatal error: %s\n", err)
+			return RCERR
+		}
+
+		for _, image := range imagesResp.Images {
+			if err := c.undeleteImage(svc, image); err != nil {
+				fmt.Printf("error undeleting AMI %s. Error details - %s\n", *image.ImageId, err)
+				rc = RCERR
+			}
+		}
+	}
+
+	if c.automode || strings.HasPrefix(c.id, "snap-") {
+
+		ec2dsi := ec2.DescribeSnapshotsInput{
+			OwnerIds: []*string{aws.String("self")},
+			Filters: []*ec2.Filter{pendingFilter,
+				&ec2.Filter{
+					Name:   aws.String("tag-key"),
+					Values: []*string{aws.String("autobkup-source-volume")}}}}
+		if !c.automode {
+			ec2dsi = ec2.DescribeSnapshotsInput{SnapshotIds: []*string{aws.String(c.id)}}
+		}
+
+		snapResp, err := svc.DescribeSnapshots(&ec2dsi)
+		if err != nil {
+			fmt.Printf("Fatal error: %s\n", err)
+			return RCERR
+		}
+
+		for _, snapshot := range snapResp.Snapshots {
+			err := clearPending(svc, []*string{snapshot.SnapshotId}, c.dryrun, c.verbose)
+			if err == nil {
+				err = c.exemptResources(svc, []*string{snapshot.SnapshotId})
+			}
+			switch {
+			case err != nil:
+				fmt.Printf("error undeleting snapshot %s. Error details - %s\n", *snapshot.SnapshotId, err)
+				rc = RCERR
+			case !c.dryrun:
+				fmt.Printf("Undeleted snapshot %s\n", *snapshot.SnapshotId)
+			}
+		}
+	}
+
+	return rc
+}
+
+// undeleteImage grants the launch permissions recorded when the AMI was marked pending-delete,
+// clears the pending state on the AMI and its snapshots and exempts them from cleanup
+func (c *UndeleteCommand) undeleteImage(svc *ec2.EC2, image *ec2.Image) error {
+
+	if _, pending := pendingDeleteSince(image.Tags); !pending {
+		fmt.Printf("AMI %s is not pending-delete\n", *image.ImageId)
+		return nil
+	}
+
+	if err := unmarkImage(svc, image, c.dryrun, c.verbose); err != nil {
+		return err
+	}
+
+	resources := []*string{image.ImageId}
+	for _, snapshotId := range imageSnapshots(image) {
+		resources = append(resources, aws.String(snapshotId))
+	}
+	if err := c.exemptResources(svc, resources); err != nil {
+		return err
+	}
+	if !c.dryrun {
+		fmt.Printf("Undeleted AMI %s\n", *image.ImageId)
+	}
+	return nil
+}
+
+// exemptResources tags the resources so ami-cleanup keeps them and does not mark them again
+func (c *UndeleteCommand) exemptResources(svc *ec2.EC2, resources []*string) error {
+
+	var ids []string
+	for _, id := range resources {
+		ids = append(ids, *id)
+	}
+
+	if c.dryrun {
+		fmt.Printf("Dry Run - Would have tagged %s on %s\n", exemptTag, strings.Join(ids, ","))
+		return nil
+	}
+
+	ec2cti := ec2.CreateTagsInput{
+		Resources: resources,
+		Tags: []*ec2.Tag{
+			&ec2.Tag{Key: aws.String(exemptTag), Value: aws.String(time.Now().UTC().Format(time.RFC3339))}}}
+
+	if _, err := svc.CreateTags(&ec2cti); err != nil {
+		return err
+	}
+	if c.verbose {
+		fmt.Printf("Info - Tagged %s on %s\n", exemptTag, strings.Join(ids, ","))
+	}
+	return nil
+}
@@ -1,7 +1,12 @@
 package main
 
 import (
+	"fmt"
 	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
 )
 
 // safeString checks if it is passed a nil pointer and if so returns an empty
@@ -22,6 +27,87 @@ func safeDateString(t *time.Time) string {
 	return t.String()
 }
 
+// tagValue returns the value of the tag with the key provided or an empty
+// string if the tag is not found
+func tagValue(tags []*ec2.Tag, key string) string {
+	for _, tag := range tags {
+		if safeString(tag.Key) == key {
+			return safeString(tag.Value)
+		}
+	}
+	return ""
+}
+
+// tagMap converts a slice of ec2 tags into a map keyed by the tag key
+func tagMap(tags []*ec2.Tag) map[string]string {
+	m := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		m[safeString(tag.Key)] = safeString(tag.Value)
+	}
+	return m
+}
+
+// accountId returns the AWS account number of the credentials in use. Every VPC and
+// EC2-Classic account has a default security group owned by the account so read it from there
+func accountId(svc *ec2.EC2) (string, error) {
+
+	ec2dsgi := ec2.DescribeSecurityGroupsInput{
+		Filters: []*ec2.Filter{
+			&ec2.Filter{
+				Name:   aws.String("group-name"),
+				Values: []*string{aws.String("default")}}}}
+
+	resp, err := svc.DescribeSecurityGroups(&ec2dsgi)
+	if err != nil {
+		return "", err
+	}
+
+	if len(resp.SecurityGroups) == 0 {
+		return "", fmt.Errorf("no default security group found to read the account number from")
+	}
+	return safeString(resp.SecurityGroups[0].OwnerId), nil
+}
+
+// metricPeriod returns the smallest CloudWatch period, in whole minutes, that keeps
+// a GetMetricStatistics request between start and end under the 1440 datapoint limit
+func metricPeriod(start, end time.Time) int64 {
+	period := int64(end.Sub(start).Seconds()) / 1440
+	if period%60 != 0 {
+		period += 60 - period%60
+	}
+	if period < 60 {
+		period = 60
+	}
+	return period
+}
+
+// errorCode returns the AWS error code of an error or an empty string if it is not an AWS error
+func errorCode(err error) string {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code()
+	}
+	return ""
+}
+
+// waitTimeout runs an SDK waiter and gives up if it has not returned within the timeout.
+// The waiter keeps polling in the background but its result is ignored
+func waitTimeout(timeout time.Duration, wait func() error) error {
+
+	if timeout <= 0 {
+		return fmt.Errorf("timed out waiting")
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- wait() }()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("timed out waiting")
+	}
+}
+
 /*
 
  */
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/mitchellh/cli"
+)
+
+type VerifyCommand struct {
+	dryrun  bool
+	verbose bool
+	dr      bool
+	amiId   string
+	config  string
+	timeout int
+	verify  verifyConfig
+	Ui      cli.Ui
+}
+
+// verifyConfig holds where and how test instances are launched
+type verifyConfig struct {
+	Subnet        string `json:"subnet"`
+	SecurityGroup string `json:"security_group"`
+	InstanceType  string `json:"instance_type"`
+	IamProfile    string `json:"iam_profile"`
+	Check         string `json:"check"`
+	Document      string `json:"document"`
+}
+
+// verifyResult records the outcome of test launching one AMI
+type verifyResult struct {
+	imageId    string
+	instanceId string
+	passed     bool
+	untested   bool
+	reason     string
+}
+
+// Help function displays detailed help for the verify-backups sub command
+func (c *VerifyCommand) Help() string {
+	return `
+	Description:
+	Verify backups by test launching the newest AMI of each backed up instance
+	into an isolated subnet and security group. The test instance must pass both
+	the EC2 instance and system status checks and the optional SSM check command
+	before it is terminated. Each AMI is tagged with autobkup-verified=pass or
+	fail and autobkup-verified-at with the time of the test.
+
+	The config file is json in the form
+	{"subnet": "subnet-0123", "security_group": "sg-0123", "instance_type": "t3.micro",
+	 "iam_profile": "arn", "check": "systemctl is-active myapp", "document": "AWS-RunShellScript"}
+	The instance type defaults to the type of the original instance. The check
+	command needs an IAM profile that allows SSM.
+
+	Usage:
+		awsgo-tools verify-backups [flags]
+
+	Flags:
+	--config <file> - json config file
+	--subnet <id> - isolated subnet to launch test instances in
+	--security-group <id> - isolated security group for test instances
+	--instance-type <type> - instance type for test instances
+	--iam-profile <arn> - IAM instance profile for test instances
+	--check <command> - SSM command that must succeed on the test instance
+	-i <AMI Id> - verify this AMI only
+	--dr - verify the DR copies made by snapshot in this region rather than the
+		original backups. Run with the region set to the DR region
+	-t <minutes> - time allowed for each test. default 20
+	-n - Dry Run. Report which AMI's would be tested
+	-v - produce verbose output
+	`
+}
+
+// Synopsis function returns a string with concise details of the sub command
+func (c *VerifyCommand) Synopsis() string {
+	return "Verify backups by test launching AMI's"
+}
+
+// Run function is the function called by the cli library to run the actual sub command code.
+func (c *VerifyCommand) Run(args []string) int {
+
+	cmdFlags := flag.NewFlagSet("verify-backups", flag.ContinueOnError)
+	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+
+	var flags verifyConfig
+	cmdFlags.StringVar(&c.config, "config", "", "Config file")
+	cmdFlags.StringVar(&flags.Subnet, "subnet", "", "Isolated subnet")
+	cmdFlags.StringVar(&flags.SecurityGroup, "security-group", "", "Isolated security group")
+	cmdFlags.StringVar(&flags.InstanceType, "instance-type", "", "Instance type")
+	cmdFlags.StringVar(&flags.IamProfile, "iam-profile", "", "IAM instance profile arn")
+	cmdFlags.StringVar(&flags.Check, "check", "", "SSM check command")
+	cmdFlags.StringVar(&c.amiId, "i", "", "AMI to verify")
+	cmdFlags.BoolVar(&c.dr, "dr", false, "Verify DR copies")
+	cmdFlags.IntVar(&c.timeout, "t", 20, "Minutes allowed for each test")
+	cmdFlags.BoolVar(&c.dryrun, "n", false, "Dry Run")
+	cmdFlags.BoolVar(&c.verbose, "v", false, "Produce verbose output")
+	if err := cmdFlags.Parse(args); err != nil {
+		return RCERR
+	}
+
+	if len(c.config) > 0 {
+		f, err := os.Open(c.config)
+		if err != nil {
+			fmt.Printf("Fatal error: unable to load config - %s\n", err)
+			return RCERR
+		}
+		err = json.NewDecoder(f).Decode(&c.verify)
+		f.Close()
+		if err != nil {
+			fmt.Printf("Fatal error: unable to load config - %s: %s\n", c.config, err)
+			return RCERR
+		}
+	}
+
+	// flags override the config file
+	for _, f := range []struct{ flag, config *string }{
+		{&flags.Subnet, &c.verify.Subnet},
+		{&flags.SecurityGroup, &c.verify.SecurityGroup},
+		{&flags.InstanceType, &c.verify.InstanceType},
+		{&flags.IamProfile, &c.verify.IamProfile},
+		{&flags.Check, &c.verify.Check}} {
+		if len(*f.flag) > 0 {
+			*f.config = *f.flag
+		}
+	}
+	if len(c.verify.Document) == 0 {
+		c.verify.Document = "AWS-RunShellScript"
+	}
+
+	// never launch restored servers where they can reach production
+	if len(c.verify.Subnet) == 0 || len(c.verify.SecurityGroup) == 0 {
+		fmt.Printf("No isolated subnet and security group provided. Please provide them with flags or in the config file\n")
+		return RCERR
+	}
+
+	// Create an EC2 service object
+	// config values keys, sercet key & region read from environment
+	svc := ec2.New(session.New(), &aws.Config{MaxRetries: aws.Int(10)})
+
+	images, err := latestBackups(svc, c.amiId, c.dr)
+	if err != nil {
+		fmt.Printf("Fatal error: %s\n", err)
+		return RCERR
+	}
+
+	if len(images) == 0 {
+		fmt.Printf("No backup AMI's found to verify\n")
+		return RCOK
+	}
+
+	var ssmsvc *ssm.SSM
+	if len(c.verify.Check) > 0 {
+		// Create an SSM service object
+		// config values keys, sercet key & region read from environment
+		ssmsvc = ssm.New(session.New(), &aws.Config{MaxRetries: aws.Int(10)})
+	}
+
+	var results []*verifyResult
+
+	for _, image := range images {
+
+		if c.dryrun {
+			fmt.Printf("Dry Run - Would have test launched AMI %s of instance %s created %s\n",
+				*image.ImageId, imageGroup(image), imageCreated(image).Format(time.RFC3339))
+			continue
+		}
+
+		result := c.verifyImage(svc, ssmsvc, image)
+		results = append(results, result)
+
+		// only record an outcome when the AMI was actually tested
+		if result.untested {
+			continue
+		}
+
+		outcome := "pass"
+		if !result.passed {
+			outcome = "fail"
+		}
+
+		ec2cti := ec2.CreateTagsInput{
+			Resources: []*string{image.ImageId},
+			Tags: []*ec2.Tag{
+				&ec2.Tag{Key: aws.String("autobkup-verified"), Value: aws.String(outcome)},
+				&ec2.Tag{Key: aws.String("autobkup-verified-at"), Value: aws.String(time.Now().UTC().Format(time.RFC3339))}}}
+
+		if _, err := svc.CreateTags(&ec2cti); err != nil {
+			fmt.Printf("Warning - problem adding tags to AMI: %s. Error was %s\n", *image.ImageId, err)
+		}
+	}
+
+	if c.dryrun {
+		return RCOK
+	}
+
+	rc := RCOK
+	fmt.Printf("\nBackup verification report\n")
+	for _, result := range results {
+		outcome := "PASS"
+		if !result.passed {
+			outcome = "FAIL"
+			rc = RCERR
+		}
+		fmt.Printf("%s\tAMI: %s\tTest instance: %s\t%s\n", outcome, result.imageId, result.instanceId, result.reason)
+	}
+
+	return rc
+}
+
+// verifyImage launches a test instance from the AMI, waits for the status checks and the check
+// command to pass and then terminates the instance
+func (c *VerifyCommand) verifyImage(svc *ec2.EC2, ssmsvc *ssm.SSM, image *ec2.Image) *verifyResult {
+
+	result := &verifyResult{imageId: *image.ImageId}
+	deadline := time.Now().Add(time.Duration(c.timeout) * time.Minute)
+
+	instanceType := c.verify.InstanceType
+	if len(instanceType) == 0 {
+		// the original instance of a DR copy is in the region the copy came from
+		srcsvc := svc
+		if region := tagValue(image.Tags, "autobkup-source-region"); len(region) > 0 {
+			// Create an EC2 service object for the source region
+			// config values keys & sercet key read from environment
+			srcsvc = ec2.New(session.New(), &aws.Config{MaxRetries: aws.Int(10), Region: aws.String(region)})
+		}
+		instanceType = sourceInstanceType(srcsvc, imageGroup(image))
+	}
+	if len(instanceType) == 0 {
+		result.untested = true
+		result.reason = "original instance not found. Please provide an instance type"
+		return result
+	}
+
+	ec2rii := ec2.RunInstancesInput{
+		ImageId:          image.ImageId,
+		InstanceType:     aws.String(instanceType),
+		SubnetId:         aws.String(c.verify.Subnet),
+		SecurityGroupIds: []*string{aws.String(c.verify.SecurityGroup)},
+		MinCount:         aws.Int64(1),
+		MaxCount:         aws.Int64(1)}
+	if len(c.verify.IamProfile) > 0 {
+		ec2rii.IamInstanceProfile = &ec2.IamInstanceProfileSpecification{Arn: aws.String(c.verify.IamProfile)}
+	}
+
+	runResp, err := svc.RunInstances(&ec2rii)
+	if err != nil {
+		result.reason = "launch failed: " + err.Error()
+		return result
+	}
+	result.instanceId = *runResp.Instances[0].InstanceId
+
+	if c.verbose {
+		fmt.Printf("Info - Launched test instance %s from AMI %s\n", result.instanceId, *image.ImageId)
+	}
+
+	// always clean up the test instance
+	defer func() {
+		_, err := svc.TerminateInstances(&ec2.TerminateInstancesInput{InstanceIds: []*string{aws.String(result.instanceId)}})
+		if err != nil {
+			fmt.Printf("Error - unable to terminate test instance %s. Please terminate it by hand. Error details - %s\n", result.instanceId, err)
+		} else if c.verbose {
+			fmt.Printf("Info - Terminated test instance %s\n", result.instanceId)
+		}
+	}()
+
+	ec2cti := ec2.CreateTagsInput{
+		Resources: []*string{aws.String(result.instanceId)},
+		Tags: []*ec2.Tag{
+			&ec2.Tag{Key: aws.String("Name"), Value: aws.String("verify-" + *image.ImageId)},
+			&ec2.Tag{Key: aws.String("autobkup-verify"), Value: image.ImageId}}}
+	if _, err = svc.CreateTags(&ec2cti); err != nil {
+		fmt.Printf("Warning - problem adding tags to test instance: %s. Error was %s\n", result.instanceId, err)
+	}
+
+	ec2disi := ec2.DescribeInstanceStatusInput{InstanceIds: []*string{aws.String(result.instanceId)}}
+
+	for _, check := range []struct {
+		name string
+		wait func(*ec2.DescribeInstanceStatusInput) error
+	}{
+		{"instance status", svc.WaitUntilInstanceStatusOk},
+		{"system status", svc.WaitUntilSystemStatusOk}} {
+
+		wait := check.wait
+		if err = waitTimeout(deadline.Sub(time.Now()), func() error { return wait(&ec2disi) }); err != nil {
+			result.reason = check.name + " check did not pass: " + err.Error()
+			return result
+		}
+		if c.verbose {
+			fmt.Printf("Info - Test instance %s passed the %s check\n", result.instanceId, check.name)
+		}
+	}
+
+	if ssmsvc != nil {
+		// the SSM agent can take a while to register after the status checks pass
+		for {
+			err = runHook(ssmsvc, result.instanceId, c.verify.Document, c.verify.Check, deadline.Sub(time.Now()))
+			if errorCode(err) != "InvalidInstanceId" || time.Now().After(deadline) {
+				break
+			}
+			time.Sleep(15 * time.Second)
+		}
+		if err != nil {
+			result.reason = "check command failed: " + err.Error()
+			return result
+		}
+	}
+
+	result.passed = true
+	result.reason = "status checks passed"
+	if ssmsvc != nil {
+		result.reason += " and check command succeeded"
+	}
+	return result
+}
+
+// latestBackups returns the AMI provided or the newest available backup AMI of each source
+// instance. DR copies are only returned in DR mode and original backups only outside it
+func latestBackups(svc *ec2.EC2, amiId string, dr bool) ([]*ec2.Image, error) {
+
+	ec2dii := ec2.DescribeImagesInput{
+		Owners: []*string{aws.String("self")},
+		Filters: []*ec2.Filter{
+			&ec2.Filter{
+				Name:   aws.String("tag-key"),
+				Values: []*string{aws.String("autocleanup")}},
+			&ec2.Filter{
+				Name:   aws.String("state"),
+				Values: []*string{aws.String(ec2.ImageStateAvailable)}}}}
+
+	if len(amiId) > 0 {
+		ec2dii = ec2.DescribeImagesInput{ImageIds: []*string{aws.String(amiId)}}
+	}
+
+	resp, err := svc.DescribeImages(&ec2dii)
+	if err != nil {
+		return nil, err
+	}
+
+	latest := make(map[string]*ec2.Image)
+	for _, image := range resp.Images {
+		copied := len(tagValue(image.Tags, "autobkup-source-image")) > 0
+		if copied != dr && len(amiId) == 0 {
+			continue
+		}
+		group := imageGroup(image)
+		if latest[group] == nil || imageCreated(image).After(imageCreated(latest[group])) {
+			latest[group] = image
+		}
+	}
+
+	var images []*ec2.Image
+	for _, image := range latest {
+		images = append(images, image)
+	}
+	sort.Slice(images, func(i, j int) bool { return imageGroup(images[i]) < imageGroup(images[j]) })
+	return images, nil
+}
+
+// sourceInstanceType returns the instance type of the instance an AMI was made from or an
+// empty string if the instance no longer exists
+func sourceInstanceType(svc *ec2.EC2, instanceId string) string {
+
+	ec2dii := ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			&ec2.Filter{
+				Name:   aws.String("instance-id"),
+				Values: []*string{aws.String(instanceId)}}}}
+
+	resp, err := svc.DescribeInstances(&ec2dii)
+	if err != nil {
+		return ""
+	}
+	for _, reservation := range resp.Reservations {
+		for _, instance := range reservation.Instances {
+			return safeString(instance.InstanceType)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// bkupVolume is an EBS volume selected for a volume snapshot along with where it is attached
+type bkupVolume struct {
+	volume     *ec2.Volume
+	instanceId string
+	device     string
+	tags       []*ec2.Tag
+}
+
+// createdSnapshot tracks a volume snapshot until it completes
+type createdSnapshot struct {
+	snapshotId string
+	volumeId   string
+	state      string
+}
+
+// snapshotVolumes snapshots the selected EBS volumes, tags each snapshot so ami-cleanup
+// expires it, and reports the snapshots that are completed, still pending and failed
+func (c *SSCommand) snapshotVolumes(svc *ec2.EC2) int {
+
+	volumes, err := getBkupVolumes(svc, c.instanceId, c.devices)
+	if err != nil {
+		fmt.Printf("Fatal error: %s\n", err)
+		return RCERR
+	}
+
+	if len(volumes) == 0 {
+		if c.verbose {
+			fmt.Printf("No volumes found to snapshot\n")
+		}
+		return RCOK
+	}
+
+	cleanupTag := &ec2.Tag{
+		Key:   aws.String("autocleanup"),
+		Value: aws.String(strconv.FormatInt(time.Now().Unix(), 10))}
+
+	var snapshots []*createdSnapshot
+
+	for _, bv := range volumes {
+
+		if c.dryrun {
+			fmt.Printf("Dry Run - Would have created snapshot of volume %s %s %s\n", *bv.volume.VolumeId, bv.instanceId, bv.device)
+			continue
+		}
+
+		ec2csi := ec2.CreateSnapshotInput{
+			VolumeId:    bv.volume.VolumeId,
+			Description: aws.String("Auto backup of volume " + *bv.volume.VolumeId + " " + bv.instanceId + " " + bv.device)}
+
+		snapResp, err := svc.CreateSnapshot(&ec2csi)
+		if err != nil {
+			fmt.Printf("Error creating snapshot of volume %s\n", *bv.volume.VolumeId)
+			fmt.Printf("Error details - %s\n", err)
+			continue
+		}
+		if c.verbose {
+			fmt.Printf("Info - Started creating snapshot: %s of volume: %s\n", *snapResp.SnapshotId, *bv.volume.VolumeId)
+		}
+
+		snapshots = append(snapshots, &createdSnapshot{
+			snapshotId: *snapResp.SnapshotId,
+			volumeId:   *bv.volume.VolumeId,
+			state:      safeString(snapResp.State)})
+
+		tags := append([]*ec2.Tag{cleanupTag}, imageTags(bv.instanceId, bv.tags, c.copyTags, c.retention)...)
+		tags = append(tags,
+			&ec2.Tag{Key: aws.String("autobkup-source-volume"), Value: bv.volume.VolumeId},
+			&ec2.Tag{Key: aws.String("autobkup-device"), Value: aws.String(bv.device)})
+
+		ec2cti := ec2.CreateTagsInput{
+			Resources: []*string{snapResp.SnapshotId},
+			Tags:      tags}
+
+		if _, err = svc.CreateTags(&ec2cti); err != nil {
+			fmt.Printf("Warning - problem adding tags to snapshot: %s. Error was %s\n", *snapResp.SnapshotId, err)
+		} else if c.verbose {
+			fmt.Printf("Info - Tagged snapshot: %s\n", *snapResp.SnapshotId)
+		}
+	}
+
+	if len(snapshots) == 0 {
+		return RCOK
+	}
+
+	if c.verbose {
+		fmt.Printf("Snapshot creation has started. Now waiting up to %d minutes for the snapshots to complete...\n", c.timeout)
+	}
+	waitForSnapshots(svc, snapshots, time.Duration(c.timeout)*time.Minute)
+
+	return snapshotReport(snapshots)
+}
+
+// getBkupVolumes returns the volumes tagged autobkup along with the volumes attached to
+// instances tagged autobkup on the devices in the instance autobkup-devices tag or the
+// devices provided. With an instance id only that instance is used and every volume is
+// selected if no devices are provided
+func getBkupVolumes(svc *ec2.EC2, bkupId string, devices string) ([]*bkupVolume, error) {
+
+	selected := make(map[string]*bkupVolume)
+
+	if len(bkupId) == 0 {
+		ec2dvi := ec2.DescribeVolumesInput{
+			Filters: []*ec2.Filter{
+				&ec2.Filter{
+					Name:   aws.String("tag-key"),
+					Values: []*string{aws.String("autobkup")}}}}
+
+		err := svc.DescribeVolumesPages(&ec2dvi, func(p *ec2.DescribeVolumesOutput, lastPage bool) bool {
+			for _, volume := range p.Volumes {
+				bv := &bkupVolume{volume: volume, tags: volume.Tags}
+				if len(volume.Attachments) > 0 {
+					bv.instanceId = safeString(volume.Attachments[0].InstanceId)
+					bv.device = safeString(volume.Attachments[0].Device)
+				}
+				selected[*volume.VolumeId] = bv
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ec2dii := ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			&ec2.Filter{
+				Name:   aws.String("tag-key"),
+				Values: []*string{aws.String("autobkup")}}}}
+	if len(bkupId) > 0 {
+		ec2dii = ec2.DescribeInstancesInput{InstanceIds: []*string{aws.String(bkupId)}}
+	}
+
+	// attached holds the volumes to look up keyed by volume id
+	attached := make(map[string]*bkupVolume)
+
+	err := svc.DescribeInstancesPages(&ec2dii, func(p *ec2.DescribeInstancesOutput, lastPage bool) bool {
+		for _, reservation := range p.Reservations {
+			for _, instance := range reservation.Instances {
+
+				wanted := make(map[string]bool)
+				instanceDevices := devices
+				if tagged := tagValue(instance.Tags, "autobkup-devices"); len(tagged) > 0 {
+					instanceDevices = tagged
+				}
+				for _, device := range splitIds(instanceDevices) {
+					wanted[*device] = true
+				}
+				if len(wanted) == 0 && len(bkupId) == 0 {
+					continue
+				}
+
+				for _, bdm := range instance.BlockDeviceMappings {
+					if bdm.Ebs == nil || (len(wanted) > 0 && !wanted[safeString(bdm.DeviceName)]) {
+						continue
+					}
+					attached[safeString(bdm.Ebs.VolumeId)] = &bkupVolume{
+						instanceId: *instance.InstanceId,
+						device:     safeString(bdm.DeviceName),
+						tags:       instance.Tags}
+				}
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var volumeIds []*string
+	for volumeId := range attached {
+		if selected[volumeId] == nil {
+			volumeIds = append(volumeIds, aws.String(volumeId))
+		}
+	}
+
+	if len(volumeIds) > 0 {
+		ec2dvi := ec2.DescribeVolumesInput{VolumeIds: volumeIds}
+		err = svc.DescribeVolumesPages(&ec2dvi, func(p *ec2.DescribeVolumesOutput, lastPage bool) bool {
+			for _, volume := range p.Volumes {
+				bv := attached[*volume.VolumeId]
+				bv.volume = volume
+				// volume tags override the instance tags they share a key with
+				bv.tags = mergeTags(bv.tags, volume.Tags)
+				selected[*volume.VolumeId] = bv
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var ids []string
+	for volumeId := range selected {
+		ids = append(ids, volumeId)
+	}
+	sort.Strings(ids)
+
+	volumes := make([]*bkupVolume, 0, len(ids))
+	for _, volumeId := range ids {
+		volumes = append(volumes, selected[volumeId])
+	}
+	return volumes, nil
+}
+
+// mergeTags returns the base tags with any tag in override replacing the base tag with the same key
+func mergeTags(base []*ec2.Tag, override []*ec2.Tag) []*ec2.Tag {
+
+	overridden := tagMap(override)
+
+	var merged []*ec2.Tag
+	for _, tag := range base {
+		if _, ok := overridden[safeString(tag.Key)]; !ok {
+			merged = append(merged, tag)
+		}
+	}
+	return append(merged, override...)
+}
+
+// waitForSnapshots waits for the pending snapshots to complete and updates the state
+// of each one. It gives up once the timeout has passed
+func waitForSnapshots(svc *ec2.EC2, snapshots []*createdSnapshot, timeout time.Duration) {
+
+	deadline := time.Now().Add(timeout)
+
+	for time.Now().Before(deadline) {
+
+		byId := make(map[string]*createdSnapshot)
+		var pending []*string
+		for _, snapshot := range snapshots {
+			if snapshot.state == ec2.SnapshotStatePending {
+				byId[snapshot.snapshotId] = snapshot
+				pending = append(pending, aws.String(snapshot.snapshotId))
+			}
+		}
+		if len(pending) == 0 {
+			return
+		}
+
+		ec2dsi := ec2.DescribeSnapshotsInput{SnapshotIds: pending}
+
+		// the waiter has no failure state so check each state whatever the result
+		waitErr := waitTimeout(deadline.Sub(time.Now()), func() error {
+			return svc.WaitUntilSnapshotCompleted(&ec2dsi)
+		})
+
+		resp, err := svc.DescribeSnapshots(&ec2dsi)
+		if err != nil {
+			fmt.Printf("Warning - unable to check snapshot state: %s\n", err)
+			return
+		}
+		for _, snapshot := range resp.Snapshots {
+			byId[*snapshot.SnapshotId].state = safeString(snapshot.State)
+		}
+
+		if waitErr != nil && !time.Now().Before(deadline) {
+			return
+		}
+	}
+}
+
+// snapshotReport displays the snapshots that are completed, still pending and failed. It returns
+// an error code if any snapshot failed
+func snapshotReport(snapshots []*createdSnapshot) int {
+
+	var completed, pending, failed []*createdSnapshot
+	for _, snapshot := range snapshots {
+		switch snapshot.state {
+		case ec2.SnapshotStateCompleted:
+			completed = append(completed, snapshot)
+		case ec2.SnapshotStatePending:
+			pending = append(pending, snapshot)
+		default:
+			failed = append(failed, snapshot)
+		}
+	}
+
+	fmt.Printf("Snapshot report - completed: %d pending: %d failed: %d\n", len(completed), len(pending), len(failed))
+	for _, group := range [][]*createdSnapshot{completed, pending, failed} {
+		for _, snapshot := range group {
+			fmt.Printf("Snapshot: %s\tVolume: %s\tState: %s\n", snapshot.snapshotId, snapshot.volumeId, snapshot.state)
+		}
+	}
+
+	if len(failed) > 0 {
+		return RCERR
+	}
+	return RCOK
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ses"
+	"github.com/aws/aws-sdk-go/service/sns"
+)
+
+// actionWarn holds back a stop until the warning period has passed
+const actionWarn = "warn"
+
+// warnedTag records when the pre-stop warning was sent for an instance
+const warnedTag = "autostop-warned"
+
+// warnConfig holds how far ahead to warn about stops and where to send the warnings
+type warnConfig struct {
+	minutes  int
+	snsTopic string
+	sesFrom  string
+	webhook  string
+}
+
+// warnedInstance is the webhook payload entry for one instance about to be stopped
+type warnedInstance struct {
+	InstanceId string `json:"instance_id"`
+	Name       string `json:"name,omitempty"`
+	Owner      string `json:"owner,omitempty"`
+	Reason     string `json:"reason"`
+}
+
+// warnDecisions holds back every stop until a warning was sent at least minutes earlier. Instances
+// that are not warned yet are changed to the warn action. When ahead is set running instances whose
+// schedule stops them within minutes are warned early so the stop is not delayed.
+// It returns the decisions to warn and the instances whose warned tag should be removed
+func warnDecisions(decisions []*autoDecision, now time.Time, holidays holidayCalendar, minutes int, ahead bool) (warn []*autoDecision, clear []*string) {
+
+	period := time.Duration(minutes) * time.Minute
+
+	for _, d := range decisions {
+
+		tags := tagMap(d.instance.Tags)
+		warnedAt, err := time.Parse(time.RFC3339, tags[warnedTag])
+		warned := len(tags[warnedTag]) > 0 && err == nil
+
+		switch d.action {
+		case actionStop:
+			switch {
+			case !warned:
+				d.action = actionWarn
+				d.reason = fmt.Sprintf("stop held for %d minutes after warning. %s", minutes, d.reason)
+				warn = append(warn, d)
+			case now.Sub(warnedAt) < period:
+				d.action = actionNone
+				d.reason = fmt.Sprintf("warned at %s. stop held until %s",
+					warnedAt.Format(time.RFC3339), warnedAt.Add(period).Format(time.RFC3339))
+			default:
+				clear = append(clear, d.instance.InstanceId)
+			}
+		case actionSkip:
+			// a deferral cancels the warning so a new one is sent when it runs out
+			if len(tags[warnedTag]) > 0 {
+				clear = append(clear, d.instance.InstanceId)
+			}
+		case actionNone:
+			stopping := false
+			if ahead {
+				future, _ := decideTags(tags, *d.instance.State.Name, now.Add(period), holidays)
+				stopping = future == actionStop
+			}
+			switch {
+			case stopping && !warned:
+				d.action = actionWarn
+				d.reason = fmt.Sprintf("schedule stops the instance within %d minutes", minutes)
+				warn = append(warn, d)
+			case !stopping && len(tags[warnedTag]) > 0:
+				clear = append(clear, d.instance.InstanceId)
+			}
+		}
+	}
+
+	return warn, clear
+}
+
+// sendWarnings sends the warning for the instances provided to every configured destination
+// and tags each instance whose warning reached at least one destination with the time it was
+// sent. Instances without a delivered warning are not tagged so they are not stopped
+func sendWarnings(svc *ec2.EC2, warn []*autoDecision, cfg warnConfig, now time.Time, dryrun bool, verbose bool) error {
+
+	if len(warn) < 1 {
+		return nil
+	}
+
+	region := safeString(svc.Config.Region)
+	subject := fmt.Sprintf("autostop will stop %d instances in %s in %d minutes", len(warn), region, cfg.minutes)
+
+	if dryrun {
+		for _, d := range warn {
+			fmt.Printf("Dry Run - Would have warned about stopping instance %s\n", *d.instance.InstanceId)
+		}
+		return nil
+	}
+
+	delivered := make(map[string]bool)
+	deliver := func(warned []*autoDecision) {
+		for _, d := range warned {
+			delivered[*d.instance.InstanceId] = true
+		}
+	}
+	var errs []string
+
+	if len(cfg.snsTopic) > 0 {
+
+		// Create an SNS service object
+		// config values keys, sercet key & region read from environment
+		snssvc := sns.New(session.New(), &aws.Config{MaxRetries: aws.Int(10)})
+
+		_, err := snssvc.Publish(&sns.PublishInput{
+			TopicArn: aws.String(cfg.snsTopic),
+			Subject:  aws.String(subject),
+			Message:  aws.String(warningMessage(warn, cfg.minutes, now))})
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("SNS publish to %s: %s", cfg.snsTopic, err))
+		} else {
+			deliver(warn)
+		}
+	}
+
+	if len(cfg.sesFrom) > 0 {
+
+		// Create an SES service object
+		// config values keys, sercet key & region read from environment
+		sessvc := ses.New(session.New(), &aws.Config{MaxRetries: aws.Int(10)})
+
+		// each owner only hears about their own instances
+		owners := make(map[string][]*autoDecision)
+		for _, d := range warn {
+			if owner := tagValue(d.instance.Tags, "owner"); len(owner) > 0 {
+				owners[owner] = append(owners[owner], d)
+			} else if verbose {
+				fmt.Printf("Info - Instance %s has no owner tag. No email warning sent\n", *d.instance.InstanceId)
+			}
+		}
+
+		for owner, owned := range owners {
+			_, err := sessvc.SendEmail(&ses.SendEmailInput{
+				Source:      aws.String(cfg.sesFrom),
+				Destination: &ses.Destination{ToAddresses: []*string{aws.String(owner)}},
+				Message: &ses.Message{
+					Subject: &ses.Content{Data: aws.String(subject)},
+					Body:    &ses.Body{Text: &ses.Content{Data: aws.String(warningMessage(owned, cfg.minutes, now))}}}})
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("SES email to %s: %s", owner, err))
+			} else {
+				deliver(owned)
+			}
+		}
+	}
+
+	if len(cfg.webhook) > 0 {
+		if err := postWarning(cfg.webhook, warn, subject, region, cfg.minutes, now); err != nil {
+			errs = append(errs, fmt.Sprintf("webhook %s: %s", cfg.webhook, err))
+		} else {
+			deliver(warn)
+		}
+	}
+
+	var ids []*string
+	for _, d := range warn {
+		if delivered[*d.instance.InstanceId] {
+			ids = append(ids, d.instance.InstanceId)
+		} else {
+			fmt.Printf("Warning - no stop warning delivered for instance %s. It will not be stopped until one is\n", *d.instance.InstanceId)
+		}
+	}
+
+	if len(ids) > 0 {
+		_, err := svc.CreateTags(&ec2.CreateTagsInput{
+			Resources: ids,
+			Tags: []*ec2.Tag{
+				&ec2.Tag{
+					Key:   aws.String(warnedTag),
+					Value: aws.String(now.UTC().Format(time.RFC3339))}}})
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("tagging warned instances: %s", err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// clearWarnings removes the warned tag from the instances provided
+func clearWarnings(svc *ec2.EC2, ids []*string, dryrun bool) {
+
+	if len(ids) < 1 || dryrun {
+		return
+	}
+
+	_, err := svc.DeleteTags(&ec2.DeleteTagsInput{
+		Resources: ids,
+		Tags:      []*ec2.Tag{&ec2.Tag{Key: aws.String(warnedTag)}}})
+	if err != nil {
+		fmt.Printf("Warning - unable to remove %s tags: %s\n", warnedTag, err)
+	}
+}
+
+// warningMessage lists the instances that will be stopped and explains how to defer the stop
+func warningMessage(warn []*autoDecision, minutes int, now time.Time) string {
+
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "autostop will stop the following instances in about %d minutes\n\n", minutes)
+	for _, d := range warn {
+		fmt.Fprintf(&b, "  %s %s - %s\n", *d.instance.InstanceId, tagValue(d.instance.Tags, "Name"), d.reason)
+	}
+
+	example := now.UTC().Add(time.Duration(minutes)*time.Minute + 2*time.Hour).Truncate(time.Hour)
+
+	fmt.Fprintf(&b, "\nTo keep an instance running add an autostop-skip-until tag with the time to defer the stop to, for example\n\n")
+	fmt.Fprintf(&b, "  aws ec2 create-tags --resources %s --tags Key=autostop-skip-until,Value=%s\n",
+		*warn[0].instance.InstanceId, example.Format(time.RFC3339))
+
+	return b.String()
+}
+
+// postWarning sends the warning to a webhook as json with the message in a text field
+// so it can be posted straight to chat tools
+func postWarning(url string, warn []*autoDecision, subject, region string, minutes int, now time.Time) error {
+
+	payload := struct {
+		Text      string            `json:"text"`
+		Subject   string            `json:"subject"`
+		Region    string            `json:"region"`
+		Minutes   int               `json:"minutes"`
+		Instances []*warnedInstance `json:"instances"`
+	}{
+		Text:    warningMessage(warn, minutes, now),
+		Subject: subject,
+		Region:  region,
+		Minutes: minutes,
+	}
+
+	for _, d := range warn {
+		payload.Instances = append(payload.Instances, &warnedInstance{
+			InstanceId: *d.instance.InstanceId,
+			Name:       tagValue(d.instance.Tags, "Name"),
+			Owner:      tagValue(d.instance.Tags, "owner"),
+			Reason:     d.reason})
+	}
+	sort.Slice(payload.Instances, func(i, j int) bool {
+		return payload.Instances[i].InstanceId < payload.Instances[j].InstanceId
+	})
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response %s", resp.Status)
+	}
+	return nil
+}